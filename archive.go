@@ -0,0 +1,153 @@
+package jdb
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const archiveTimeFormat = "20060102T150405.000000000Z"
+
+// Archive is a segment of the transaction log that was saved by Compact.
+type Archive struct {
+	Path       string
+	Time       time.Time // when the segment got archived
+	Compressed bool
+}
+
+// Archives returns the archived segments of the database, oldest first.
+func (db *DB) Archives() ([]*Archive, error) {
+	if db.opts.ArchiveDir == "" {
+		return nil, nil
+	}
+	return ListArchives(db.opts.ArchiveDir, db.Name())
+}
+
+// ReplayArchive returns a read-only in-memory database rebuilt from an archived segment
+// as it was at the point selected by ro, a nil ro replays the whole segment.
+// be is the backend that wrote the segment, nil means the current one. Segments archived by or before a Rekey
+// were written with the old backend, replaying them with another one fails with ErrBackendMismatch.
+func (db *DB) ReplayArchive(a *Archive, be func() Backend, ro *ReplayOpts) (*DB, error) {
+	db.mux.RLock()
+	opts := db.opts
+	db.mux.RUnlock()
+
+	if be != nil {
+		opts.Backend = be
+	}
+	return OpenArchive(a, &opts, ro)
+}
+
+// ListArchives returns the archived segments of the database file fp found in dir, oldest first.
+func ListArchives(dir, fp string) ([]*Archive, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	prefix := filepath.Base(fp) + "."
+
+	var out []*Archive
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		ts := strings.TrimPrefix(name, prefix)
+		gz := strings.HasSuffix(ts, ".gz")
+		t, err := time.Parse(archiveTimeFormat, strings.TrimSuffix(ts, ".gz"))
+		if err != nil {
+			continue
+		}
+
+		out = append(out, &Archive{
+			Path:       filepath.Join(dir, name),
+			Time:       t,
+			Compressed: gz,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// OpenArchive is like OpenAt for an archived segment.
+func OpenArchive(a *Archive, opts *Opts, ro *ReplayOpts) (*DB, error) {
+	if !a.Compressed {
+		return OpenAt(a.Path, opts, ro)
+	}
+
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return openAt(gz, a.Path, opts, ro)
+}
+
+// archive copies the current transaction log to the archive directory.
+func (db *DB) archive() (err error) {
+	src, err := os.Open(db.Name())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err = os.MkdirAll(db.opts.ArchiveDir, 0700); err != nil {
+		return err
+	}
+
+	fp := filepath.Join(db.opts.ArchiveDir, filepath.Base(db.Name())+"."+time.Now().UTC().Format(archiveTimeFormat))
+	if db.opts.CompressArchives {
+		fp += ".gz"
+	}
+
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(fp)
+		}
+	}()
+
+	var (
+		w  io.Writer = f
+		gz *gzip.Writer
+	)
+	if db.opts.CompressArchives {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+
+	if _, err = io.Copy(w, src); err != nil {
+		return err
+	}
+
+	if gz != nil {
+		if err = gz.Close(); err != nil {
+			return err
+		}
+	}
+
+	return f.Sync()
+}
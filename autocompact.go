@@ -0,0 +1,122 @@
+package jdb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AutoCompact is used by Opts.AutoCompact, every non-zero field is a trigger that compacts the database in the background.
+// Automatic compactions never overlap with each other or with Compact and Rekey, their results are reported by DB.Stats.
+type AutoCompact struct {
+	// Ratio compacts once the file is Ratio times larger than the live data, which is estimated
+	// from the size of the file written by the last compaction.
+	Ratio float64
+	// MinSize is the smallest file size Ratio compacts.
+	MinSize int64
+
+	// Txs compacts once that many transactions were written since the last compaction.
+	Txs int64
+
+	// Interval compacts every Interval if any transactions were written since the last compaction.
+	Interval time.Duration
+}
+
+// compacted is called with wmux held after the file was replaced by a compacted file of the given size.
+func (db *DB) compacted(size, live int64) {
+	atomic.StoreInt64(&db.size, size)
+	atomic.StoreInt64(&db.txs, 0)
+	db.compactedAt = time.Now()
+	db.overhead = 1
+	if live > 0 {
+		db.overhead = float64(size) / float64(live)
+	}
+}
+
+// needsCompact must be called with wmux held.
+func (db *DB) needsCompact() bool {
+	ac := &db.opts.AutoCompact
+	txs := atomic.LoadInt64(&db.txs)
+	if txs == 0 {
+		return false
+	}
+
+	if ac.Txs > 0 && txs >= ac.Txs {
+		return true
+	}
+
+	if ac.Interval > 0 && time.Since(db.compactedAt) >= ac.Interval {
+		return true
+	}
+
+	if ac.Ratio > 0 {
+		size := atomic.LoadInt64(&db.size)
+		live := float64(db.snapshot().size) * db.overhead
+		return size >= ac.MinSize && float64(size) > ac.Ratio*live
+	}
+
+	return false
+}
+
+// startCompactor starts the background goroutine used by Opts.AutoCompact,
+// it checks the triggers after every commit and every Interval.
+func (db *DB) startCompactor() {
+	ac := db.opts.AutoCompact
+	if ac == (AutoCompact{}) || db.readOnly {
+		return
+	}
+
+	db.compactedAt, db.overhead = time.Now(), 1
+	kick, stop := make(chan struct{}, 1), make(chan struct{})
+	db.compactKick, db.compactStop = kick, stop
+
+	db.compactorWg.Add(1)
+	go func() {
+		defer db.compactorWg.Done()
+
+		var tick <-chan time.Time
+		if ac.Interval > 0 {
+			t := time.NewTicker(ac.Interval)
+			defer t.Stop()
+			tick = t.C
+		}
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-kick:
+			case <-tick:
+			}
+
+			db.wmux.Lock()
+			if !db.isClosed() && db.needsCompact() {
+				// the error is reported by Stats
+				db.compactLocked(nil, true)
+			}
+			db.wmux.Unlock()
+		}
+	}()
+}
+
+// kickCompactor makes the compactor check its triggers, it never blocks.
+func (db *DB) kickCompactor() {
+	if db.compactKick == nil {
+		return
+	}
+	select {
+	case db.compactKick <- struct{}{}:
+	default:
+	}
+}
+
+func (db *DB) stopCompactor() {
+	db.wmux.Lock()
+	stop := db.compactStop
+	db.compactStop = nil
+	db.wmux.Unlock()
+
+	if stop != nil {
+		close(stop)
+		db.compactorWg.Wait()
+	}
+}
@@ -0,0 +1,68 @@
+package cbor
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/OneOfOne/jdb"
+	cb "github.com/fxamacker/cbor/v2"
+)
+
+// encoding uses the RFC 8949 core deterministic encoding, map keys are sorted and integers use the shortest form,
+// so databases with the same contents produce the same jdb.DB.Snapshot byte for byte.
+// The files written by Compact still differ, they hold the creation time and the index and time of the transaction.
+// The decoder limits are raised to their maximum, the defaults reject buckets with more than 131072 keys
+// or nested more than about 15 deep.
+var (
+	encMode cb.EncMode
+	decMode cb.DecMode
+)
+
+func init() {
+	var err error
+	if encMode, err = cb.CoreDetEncOptions().EncMode(); err != nil {
+		panic(err)
+	}
+	if decMode, err = (cb.DecOptions{
+		MaxNestedLevels:  65535,
+		MaxArrayElements: 2147483647,
+		MaxMapPairs:      2147483647,
+	}).DecMode(); err != nil {
+		panic(err)
+	}
+}
+
+// Backend returns a CBOR backend using deterministic encoding,
+// transactions use the same short field names as the json backend.
+func Backend() jdb.Backend { return &backend{} }
+
+type backend struct {
+	w   io.Writer
+	buf bytes.Buffer
+	enc *cb.Encoder
+	dec *cb.Decoder
+}
+
+func (b *backend) Init(w io.Writer, r io.Reader) error {
+	b.w = w
+	b.enc, b.dec = encMode.NewEncoder(&b.buf), decMode.NewDecoder(r)
+	return nil
+}
+
+// Flush writes the buffered transaction with a single write.
+func (b *backend) Flush() error {
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	_, err := b.w.Write(b.buf.Bytes())
+	b.buf.Reset()
+	return err
+}
+
+func (b *backend) Encode(v interface{}) error { return b.enc.Encode(v) }
+func (b *backend) Decode(v interface{}) error { return b.dec.Decode(v) }
+
+func (b *backend) BackendName() string { return "cbor" }
+
+func (b *backend) Marshal(in interface{}) ([]byte, error)     { return encMode.Marshal(in) }
+func (b *backend) Unmarshal(in []byte, out interface{}) error { return decMode.Unmarshal(in, out) }
@@ -0,0 +1,140 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/OneOfOne/jdb"
+	"github.com/klauspost/compress/dict"
+)
+
+var (
+	// ErrCorrupt is returned when a record can't be decompressed.
+	ErrCorrupt = errors.New("compress: corrupt record")
+
+	ErrNotEnoughSamples = errors.New("compress: not enough samples to build a dictionary")
+)
+
+// every transaction is compressed independently and stored as:
+//
+//	size uint32 | data [size]byte
+//
+// so the file can be scanned from any record boundary.
+const sizeLen = 4
+
+type codec interface {
+	name() string
+	init() error
+	compress(dst, src []byte) ([]byte, error)
+	decompress(dst, src []byte) ([]byte, error)
+	close()
+}
+
+type backend struct {
+	be jdb.Backend
+	c  codec
+
+	w   io.Writer
+	buf bytes.Buffer
+	rec []byte
+
+	r   io.Reader
+	out []byte
+	raw []byte
+}
+
+func (b *backend) Init(w io.Writer, r io.Reader) error {
+	if err := b.c.init(); err != nil {
+		return err
+	}
+	b.w, b.r = w, r
+	return b.be.Init(&b.buf, reader{b})
+}
+
+// Flush compresses everything the wrapped backend wrote since the last flush as a single record.
+func (b *backend) Flush() error {
+	if err := b.be.Flush(); err != nil {
+		return err
+	}
+	if b.buf.Len() == 0 {
+		return nil
+	}
+
+	rec, err := b.c.compress(append(b.rec[:0], make([]byte, sizeLen)...), b.buf.Bytes())
+	b.buf.Reset()
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(rec, uint32(len(rec)-sizeLen))
+	b.rec = rec
+
+	_, err = b.w.Write(rec)
+	return err
+}
+
+// next reads and decompresses the next record.
+func (b *backend) next() error {
+	var size [sizeLen]byte
+	if _, err := io.ReadFull(b.r, size[:]); err != nil {
+		return err
+	}
+
+	var rec bytes.Buffer
+	if _, err := io.CopyN(&rec, b.r, int64(binary.LittleEndian.Uint32(size[:]))); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	out, err := b.c.decompress(b.raw[:0], rec.Bytes())
+	if err != nil {
+		return err
+	}
+	b.raw, b.out = out, out
+	return nil
+}
+
+func (b *backend) Encode(v interface{}) error                 { return b.be.Encode(v) }
+func (b *backend) Decode(v interface{}) error                 { return b.be.Decode(v) }
+func (b *backend) Marshal(in interface{}) ([]byte, error)     { return b.be.Marshal(in) }
+func (b *backend) Unmarshal(in []byte, out interface{}) error { return b.be.Unmarshal(in, out) }
+
+func (b *backend) BackendName() string { return b.c.name() + ">" + jdb.BackendName(b.be) }
+
+func (b *backend) Close() error {
+	err := b.Flush()
+	b.c.close()
+	return err
+}
+
+type reader struct{ b *backend }
+
+func (r reader) Read(p []byte) (int, error) {
+	for len(r.b.out) == 0 {
+		if err := r.b.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.b.out)
+	r.b.out = r.b.out[n:]
+	return n, nil
+}
+
+// BuildDict builds a dictionary of up to size bytes for ZstdBackend from samples,
+// it looks for data repeated across samples so it needs many of them, for example the transactions of an existing database.
+// The same dictionary must be used every time the database is opened.
+func BuildDict(size int, samples ...[]byte) (d []byte, err error) {
+	if len(samples) < 2 {
+		return nil, ErrNotEnoughSamples
+	}
+	// the builder panics if nothing repeats
+	defer func() {
+		if recover() != nil {
+			d, err = nil, ErrNotEnoughSamples
+		}
+	}()
+	return dict.BuildRawDict(samples, dict.Options{MaxDictSize: size, HashBytes: 6})
+}
@@ -0,0 +1,65 @@
+package compress
+
+import (
+	"encoding/binary"
+
+	"github.com/OneOfOne/jdb"
+	"github.com/pierrec/lz4/v4"
+)
+
+// LZ4Backend returns a wrapper backend where every transaction is compressed with LZ4,
+// it's faster than zstd and gzip at the cost of a worse ratio.
+// Records are raw LZ4 blocks with a size prefix rather than the LZ4 frame format, so tools like lz4(1) can't read them.
+func LZ4Backend(be jdb.Backend) jdb.Backend {
+	return &backend{be: be, c: &lz4Codec{}}
+}
+
+// records use the LZ4 block format, prefixed with the little endian uncompressed size:
+//
+//	size uint32 | block []byte
+//
+// There is no frame header, checksum or block size limit.
+const lz4SizeLen = 4
+
+type lz4Codec struct {
+	c   lz4.Compressor
+	out []byte
+}
+
+func (c *lz4Codec) name() string { return "lz4" }
+
+func (c *lz4Codec) init() error { return nil }
+
+func (c *lz4Codec) close() {}
+
+func (c *lz4Codec) compress(dst, src []byte) ([]byte, error) {
+	i := len(dst)
+	dst = append(dst, make([]byte, lz4SizeLen+lz4.CompressBlockBound(len(src)))...)
+	binary.LittleEndian.PutUint32(dst[i:], uint32(len(src)))
+
+	n, err := c.c.CompressBlock(src, dst[i+lz4SizeLen:])
+	if err != nil {
+		return nil, err
+	}
+	return dst[:i+lz4SizeLen+n], nil
+}
+
+func (c *lz4Codec) decompress(dst, src []byte) ([]byte, error) {
+	if len(src) < lz4SizeLen {
+		return nil, ErrCorrupt
+	}
+	// a byte of the block expands to at most 255, so a corrupt size can't make us allocate much more than the record
+	size := int(binary.LittleEndian.Uint32(src))
+	if src = src[lz4SizeLen:]; size > len(src)*255 {
+		return nil, ErrCorrupt
+	}
+
+	if cap(c.out) < size {
+		c.out = make([]byte, size)
+	}
+	out := c.out[:size]
+	if n, err := lz4.UncompressBlock(src, out); err != nil || n != size {
+		return nil, ErrCorrupt
+	}
+	return append(dst, out...), nil
+}
@@ -0,0 +1,56 @@
+package compress
+
+import (
+	"hash/crc32"
+
+	"github.com/OneOfOne/jdb"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ZstdBackend is an alias for ZstdLevelBackend(be, 3, dict)
+func ZstdBackend(be jdb.Backend, dict []byte) jdb.Backend { return ZstdLevelBackend(be, 3, dict) }
+
+// ZstdLevelBackend returns a wrapper backend where every transaction is compressed with zstd,
+// level is the zstd compression level (1-22) and dict is an optional dictionary, see BuildDict.
+func ZstdLevelBackend(be jdb.Backend, level int, dict []byte) jdb.Backend {
+	return &backend{be: be, c: &zstdCodec{level: zstd.EncoderLevelFromZstd(level), dict: dict}}
+}
+
+type zstdCodec struct {
+	level zstd.EncoderLevel
+	dict  []byte
+	enc   *zstd.Encoder
+	dec   *zstd.Decoder
+}
+
+func (c *zstdCodec) name() string { return "zstd" }
+
+func (c *zstdCodec) init() (err error) {
+	eo := []zstd.EOption{zstd.WithEncoderLevel(c.level), zstd.WithEncoderConcurrency(1)}
+	do := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if c.dict != nil {
+		// the id is stored in every frame, so opening the file with another dictionary fails
+		id := crc32.ChecksumIEEE(c.dict) | 1
+		eo = append(eo, zstd.WithEncoderDictRaw(id, c.dict))
+		do = append(do, zstd.WithDecoderDictRaw(id, c.dict))
+	}
+
+	if c.enc, err = zstd.NewWriter(nil, eo...); err != nil {
+		return err
+	}
+	c.dec, err = zstd.NewReader(nil, do...)
+	return err
+}
+
+func (c *zstdCodec) compress(dst, src []byte) ([]byte, error) { return c.enc.EncodeAll(src, dst), nil }
+
+func (c *zstdCodec) decompress(dst, src []byte) ([]byte, error) { return c.dec.DecodeAll(src, dst) }
+
+func (c *zstdCodec) close() {
+	if c.enc != nil {
+		c.enc.Close()
+	}
+	if c.dec != nil {
+		c.dec.Close()
+	}
+}
@@ -10,36 +10,91 @@ import (
 	"github.com/OneOfOne/jdb"
 )
 
+// stream is CFB mode with a single state for both directions, the file is always read to the end
+// before anything gets appended to it, so writes continue the stream right where the reads stopped.
+// The output is the same as cipher.NewCFBEncrypter and cipher.NewCFBDecrypter, but those keep separate
+// states that both start at the IV, so data appended to an existing file was encrypted with the wrong keystream.
+type stream struct {
+	b    cipher.Block
+	next []byte
+	out  []byte
+	used int
+}
+
+func newStream(b cipher.Block, iv []byte) *stream {
+	return &stream{
+		b:    b,
+		next: append([]byte(nil), iv...),
+		out:  make([]byte, b.BlockSize()),
+		used: b.BlockSize(),
+	}
+}
+
+func (s *stream) xor(dst, src []byte, decrypt bool) {
+	for len(src) > 0 {
+		if s.used == len(s.out) {
+			s.b.Encrypt(s.out, s.next)
+			s.used = 0
+		}
+
+		if decrypt {
+			copy(s.next[s.used:], src)
+		}
+
+		n := len(s.out) - s.used
+		if n > len(src) {
+			n = len(src)
+		}
+		for i, c := range s.out[s.used : s.used+n] {
+			dst[i] = src[i] ^ c
+		}
+
+		if !decrypt {
+			copy(s.next[s.used:], dst[:n])
+		}
+
+		dst, src = dst[n:], src[n:]
+		s.used += n
+	}
+}
+
 type writer struct {
-	s cipher.Stream
+	s *stream
 	w io.Writer
 }
 
 func (w writer) Write(src []byte) (n int, err error) {
-	w.s.XORKeyStream(src, src)
-	return w.w.Write(src)
+	dst := make([]byte, len(src))
+	w.s.xor(dst, src, false)
+	return w.w.Write(dst)
 }
 
 type reader struct {
-	s cipher.Stream
+	s *stream
 	r io.Reader
 }
 
 func (r reader) Read(dst []byte) (n int, err error) {
-	if n, err = r.r.Read(dst); err != nil {
-		return
-	}
-	r.s.XORKeyStream(dst, dst[:n])
+	n, err = r.r.Read(dst)
+	r.s.xor(dst[:n], dst[:n], true)
 	return n, err
 }
 
 type aesBackend struct {
-	be  jdb.Backend
-	key []byte
+	be   jdb.Backend
+	key  []byte
+	pass []byte
 }
 
 func (be aesBackend) Init(w io.Writer, r io.Reader) error {
-	block, err := aes.NewCipher(be.key)
+	key := be.key
+	if be.pass != nil {
+		var err error
+		if key, err = passphraseKey(w, r, be.pass); err != nil {
+			return err
+		}
+	}
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return err
 	}
@@ -56,15 +111,18 @@ func (be aesBackend) Init(w io.Writer, r io.Reader) error {
 	default:
 		return err
 	}
-	w = writer{cipher.NewCFBEncrypter(block, iv), w}
-	r = reader{cipher.NewCFBDecrypter(block, iv), r}
-	return be.be.Init(w, r)
+	s := newStream(block, iv)
+	return be.be.Init(writer{s, w}, reader{s, r})
 }
 
 func (be aesBackend) Flush() error {
 	return be.be.Flush()
 }
 
+func (be aesBackend) BackendName() string {
+	return kdfName("aes-cfb", be.pass) + jdb.BackendName(be.be)
+}
+
 func (be aesBackend) Encode(v interface{}) error                 { return be.be.Encode(v) }
 func (be aesBackend) Decode(v interface{}) error                 { return be.be.Decode(v) }
 func (be aesBackend) Marshal(in interface{}) ([]byte, error)     { return be.be.Marshal(in) }
@@ -75,6 +133,14 @@ func (be aesBackend) Unmarshal(in []byte, out interface{}) error { return be.be.
 // 16, 24 or 32 bytes to select AES-128, AES-192, or AES-256.
 func AESBackend(be func() jdb.Backend, key []byte) func() jdb.Backend {
 	return func() jdb.Backend {
-		return aesBackend{be(), key}
+		return aesBackend{be: be(), key: key}
+	}
+}
+
+// AESPassphraseBackend is like AESBackend with an AES-256 key derived from passphrase using argon2id,
+// the salt and KDF parameters are stored in the file header before the IV.
+func AESPassphraseBackend(be func() jdb.Backend, passphrase []byte) func() jdb.Backend {
+	return func() jdb.Backend {
+		return aesBackend{be: be(), pass: passphrase}
 	}
 }
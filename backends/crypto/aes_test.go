@@ -0,0 +1,115 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// sizes are the odd write and read sizes used to cross block boundaries at every offset.
+var sizes = []int{1, 3, 5, 7, 15, 16, 17, 31, 33, 64, 100}
+
+func chunks(b []byte, fn func(p []byte)) {
+	for i := 0; len(b) > 0; i++ {
+		n := sizes[i%len(sizes)]
+		if n > len(b) {
+			n = len(b)
+		}
+		fn(b[:n])
+		b = b[n:]
+	}
+}
+
+// TestStreamVector checks the stream against the CFB128-AES128 vector from NIST SP 800-38A, F.3.13.
+func TestStreamVector(t *testing.T) {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	block, err := aes.NewCipher(unhex("2b7e151628aed2a6abf7158809cf4f3c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := unhex("000102030405060708090a0b0c0d0e0f")
+	pt := unhex("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710")
+	ct := unhex("3b3fd92eb72dad20333449f8e83cfb4ac8a64537a0b3a93fcde3cdad9f1ce58b" +
+		"26751f67a3cbb140b1808cf187a4f4dfc04b05357c5d1c0eeac4c66f9ff7f2e6")
+
+	var buf bytes.Buffer
+	w := writer{newStream(block, iv), &buf}
+	chunks(pt, func(p []byte) { w.Write(p) })
+	if !bytes.Equal(buf.Bytes(), ct) {
+		t.Fatalf("expected %x, got %x", ct, buf.Bytes())
+	}
+}
+
+// TestStreamCFB checks that the stream is interchangeable with the standard library CFB mode
+// with odd sized writes and reads, and that writing continues the stream where reading stopped.
+func TestStreamCFB(t *testing.T) {
+	key, iv, pt := make([]byte, 32), make([]byte, aes.BlockSize), make([]byte, 4099)
+	rand.Read(key)
+	rand.Read(iv)
+	rand.Read(pt)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct := make([]byte, len(pt))
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(ct, pt)
+
+	var buf bytes.Buffer
+	w := writer{newStream(block, iv), &buf}
+	chunks(pt, func(p []byte) {
+		src := append([]byte(nil), p...)
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, src) {
+			t.Fatal("Write modified its input")
+		}
+	})
+	if !bytes.Equal(buf.Bytes(), ct) {
+		t.Fatal("the encrypted data doesn't match cipher.NewCFBEncrypter")
+	}
+
+	var got []byte
+	r := reader{newStream(block, iv), bytes.NewReader(ct)}
+	chunks(make([]byte, len(ct)), func(p []byte) {
+		n, err := io.ReadFull(r, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p[:n]...)
+	})
+	exp := make([]byte, len(ct))
+	cipher.NewCFBDecrypter(block, iv).XORKeyStream(exp, ct)
+	if !bytes.Equal(got, exp) || !bytes.Equal(got, pt) {
+		t.Fatal("the decrypted data doesn't match cipher.NewCFBDecrypter")
+	}
+
+	// read part of the data, then write the rest with the same stream, like appending to a file
+	for _, n := range []int{0, 1, 15, 16, 17, 1000} {
+		s := newStream(block, iv)
+		p := make([]byte, n)
+		if _, err = io.ReadFull(reader{s, bytes.NewReader(ct[:n])}, p); err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		w := writer{s, &buf}
+		chunks(pt[n:], func(p []byte) { w.Write(p) })
+		if !bytes.Equal(buf.Bytes(), ct[n:]) {
+			t.Fatalf("%d: appended data doesn't continue the stream", n)
+		}
+	}
+}
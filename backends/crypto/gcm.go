@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/OneOfOne/jdb"
+)
+
+// ErrAuthFailed is wrapped by every *AuthError.
+var ErrAuthFailed = errors.New("crypto: message authentication failed")
+
+// AuthError is returned by the GCM backend when a record was tampered with or truncated.
+type AuthError struct {
+	Record uint64 // the position of the transaction in the file, starting at 0
+	Offset int64  // the offset of the record, it's the file offset unless jdb.Opts.Checksum is set
+	Err    error  // the underlying error, usually from cipher.AEAD.Open
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%v: transaction #%d at offset %d: %v", ErrAuthFailed, e.Record, e.Offset, e.Err)
+}
+
+// Unwrap returns ErrAuthFailed and Err, a truncated record matches io.ErrUnexpectedEOF.
+func (e *AuthError) Unwrap() []error { return []error{ErrAuthFailed, e.Err} }
+
+// every record is stored as size uint32 | nonce | sealed, the record number is used as additional data
+// so records can't be reordered or removed from the middle of the file.
+const gcmSizeLen = 4
+
+type gcmBackend struct {
+	be   jdb.Backend
+	key  []byte
+	pass []byte
+	aead cipher.AEAD
+
+	w   io.Writer
+	buf bytes.Buffer
+
+	r   io.Reader
+	pt  []byte
+	rec uint64 // number of records read or written so far
+	off int64
+}
+
+func (g *gcmBackend) Init(w io.Writer, r io.Reader) error {
+	if g.pass != nil {
+		var err error
+		if g.key, err = passphraseKey(w, r, g.pass); err != nil {
+			return err
+		}
+		g.off = kdfHeaderSize
+	}
+	block, err := aes.NewCipher(g.key)
+	if err != nil {
+		return err
+	}
+	if g.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	g.w, g.r = w, r
+	return g.be.Init(&g.buf, gcmReader{g})
+}
+
+// Flush seals everything the wrapped backend wrote since the last flush as a single record.
+func (g *gcmBackend) Flush() error {
+	if err := g.be.Flush(); err != nil {
+		return err
+	}
+	if g.buf.Len() == 0 {
+		return nil
+	}
+
+	ns := g.aead.NonceSize()
+	rec := make([]byte, gcmSizeLen+ns, gcmSizeLen+ns+g.buf.Len()+g.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, rec[gcmSizeLen:]); err != nil {
+		return fmt.Errorf("error reading nonce: %v", err)
+	}
+
+	rec = g.aead.Seal(rec, rec[gcmSizeLen:], g.buf.Bytes(), g.ad())
+	binary.LittleEndian.PutUint32(rec, uint32(len(rec)-gcmSizeLen))
+	g.buf.Reset()
+
+	if _, err := g.w.Write(rec); err != nil {
+		return err
+	}
+	g.rec++
+	g.off += int64(len(rec))
+	return nil
+}
+
+func (g *gcmBackend) ad() []byte {
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], g.rec)
+	return ad[:]
+}
+
+// next reads and opens the next record.
+func (g *gcmBackend) next() error {
+	var size [gcmSizeLen]byte
+	if _, err := io.ReadFull(g.r, size[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return g.authErr(err)
+		}
+		return err
+	}
+
+	var rec bytes.Buffer
+	n := int64(binary.LittleEndian.Uint32(size[:]))
+	if _, err := io.CopyN(&rec, g.r, n); err != nil {
+		if err == io.EOF {
+			return g.authErr(io.ErrUnexpectedEOF)
+		}
+		return err
+	}
+
+	ns := g.aead.NonceSize()
+	if n < int64(ns) {
+		return g.authErr(io.ErrUnexpectedEOF)
+	}
+
+	b := rec.Bytes()
+	pt, err := g.aead.Open(b[ns:ns], b[:ns], b[ns:], g.ad())
+	if err != nil {
+		return g.authErr(err)
+	}
+
+	g.pt = pt
+	g.rec++
+	g.off += gcmSizeLen + n
+	return nil
+}
+
+func (g *gcmBackend) authErr(err error) error {
+	return &AuthError{Record: g.rec, Offset: g.off, Err: err}
+}
+
+func (g *gcmBackend) BackendName() string { return kdfName("aes-gcm", g.pass) + jdb.BackendName(g.be) }
+
+func (g *gcmBackend) Encode(v interface{}) error                 { return g.be.Encode(v) }
+func (g *gcmBackend) Decode(v interface{}) error                 { return g.be.Decode(v) }
+func (g *gcmBackend) Marshal(in interface{}) ([]byte, error)     { return g.be.Marshal(in) }
+func (g *gcmBackend) Unmarshal(in []byte, out interface{}) error { return g.be.Unmarshal(in, out) }
+
+type gcmReader struct{ g *gcmBackend }
+
+func (r gcmReader) Read(p []byte) (int, error) {
+	for len(r.g.pt) == 0 {
+		if err := r.g.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.g.pt)
+	r.g.pt = r.g.pt[n:]
+	return n, nil
+}
+
+// GCMBackend returns a backend that seals every transaction with AES-GCM, using a random nonce per transaction.
+// Unlike AESBackend, any modification to the file is detected and returned as an *AuthError.
+// The AES strength depends on the size of the key,
+// 16, 24 or 32 bytes to select AES-128, AES-192, or AES-256.
+func GCMBackend(be func() jdb.Backend, key []byte) func() jdb.Backend {
+	return func() jdb.Backend {
+		return &gcmBackend{be: be(), key: key}
+	}
+}
+
+// GCMPassphraseBackend is like GCMBackend with an AES-256 key derived from passphrase using argon2id,
+// the salt and KDF parameters are stored in the file header.
+func GCMPassphraseBackend(be func() jdb.Backend, passphrase []byte) func() jdb.Backend {
+	return func() jdb.Backend {
+		return &gcmBackend{be: be(), pass: passphrase}
+	}
+}
@@ -0,0 +1,117 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var (
+	ErrBadPassphrase = errors.New("crypto: wrong passphrase")
+	ErrBadHeader     = errors.New("crypto: invalid passphrase header")
+)
+
+// KDFParams are the argon2id parameters used to derive a key from a passphrase.
+type KDFParams struct {
+	Time    uint32
+	Memory  uint32 // in KiB
+	Threads uint8
+}
+
+// DefaultKDFParams are used when creating new files, existing files always use the parameters stored in their header.
+var DefaultKDFParams = KDFParams{Time: 1, Memory: 64 * 1024, Threads: 4}
+
+// MaxKDFMemory is the most memory the parameters in a file header may ask for, in KiB.
+var MaxKDFMemory uint32 = 4 << 20
+
+// valid reports whether argon2 accepts p and it doesn't ask for more than MaxKDFMemory,
+// the parameters come from the file so they can't be trusted.
+func (p KDFParams) valid() bool {
+	return p.Time > 0 && p.Threads > 0 && p.Memory >= 8*uint32(p.Threads) && p.Memory <= MaxKDFMemory
+}
+
+// passphrase protected files start with a header:
+//
+//	magic [4]byte | kdf uint8 | time uint32 | memory uint32 | threads uint8 | salt [16]byte | check [16]byte
+//
+// check is derived along with the key, so a wrong passphrase is detected before decrypting anything.
+const (
+	kdfMagic      = "jdbk"
+	kdfArgon2id   = 1
+	kdfSaltLen    = 16
+	kdfCheckLen   = 16
+	kdfKeyLen     = 32
+	kdfHeaderSize = 4 + 1 + 4 + 4 + 1 + kdfSaltLen + kdfCheckLen
+)
+
+// kdfName returns the header name of a backend, with the kdf if its key is derived from a passphrase
+// so the file can't be opened with a raw key.
+func kdfName(name string, pass []byte) string {
+	if pass != nil {
+		name += "+argon2id"
+	}
+	return name + ">"
+}
+
+// passphraseKey reads the header from r, or writes a new one to w if r is empty, and returns the derived key.
+func passphraseKey(w io.Writer, r io.Reader, pass []byte) ([]byte, error) {
+	hdr := make([]byte, kdfHeaderSize)
+	switch _, err := io.ReadFull(r, hdr); err {
+	case nil:
+		if string(hdr[:4]) != kdfMagic || hdr[4] != kdfArgon2id {
+			return nil, ErrBadHeader
+		}
+		p := KDFParams{
+			Time:    binary.LittleEndian.Uint32(hdr[5:]),
+			Memory:  binary.LittleEndian.Uint32(hdr[9:]),
+			Threads: hdr[13],
+		}
+		if !p.valid() {
+			return nil, ErrBadHeader
+		}
+		key, check := p.derive(pass, hdr[14:14+kdfSaltLen])
+		if subtle.ConstantTimeCompare(check, hdr[14+kdfSaltLen:]) != 1 {
+			return nil, ErrBadPassphrase
+		}
+		return key, nil
+
+	case io.EOF:
+		p := DefaultKDFParams
+		if !p.valid() {
+			return nil, fmt.Errorf("crypto: invalid DefaultKDFParams: %+v", p)
+		}
+		copy(hdr, kdfMagic)
+		hdr[4] = kdfArgon2id
+		binary.LittleEndian.PutUint32(hdr[5:], p.Time)
+		binary.LittleEndian.PutUint32(hdr[9:], p.Memory)
+		hdr[13] = p.Threads
+
+		salt := hdr[14 : 14+kdfSaltLen]
+		if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, fmt.Errorf("error reading salt: %v", err)
+		}
+
+		key, check := p.derive(pass, salt)
+		copy(hdr[14+kdfSaltLen:], check)
+		if _, err = w.Write(hdr); err != nil {
+			return nil, fmt.Errorf("error writing header: %v", err)
+		}
+		return key, nil
+
+	case io.ErrUnexpectedEOF:
+		return nil, ErrBadHeader
+
+	default:
+		return nil, err
+	}
+}
+
+func (p KDFParams) derive(pass, salt []byte) (key, check []byte) {
+	k := argon2.IDKey(pass, salt, p.Time, p.Memory, p.Threads, kdfKeyLen+kdfCheckLen)
+	return k[:kdfKeyLen], k[kdfKeyLen:]
+}
@@ -0,0 +1,87 @@
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/OneOfOne/jdb"
+	mp "github.com/vmihailenco/msgpack/v5"
+)
+
+// Backend returns a MessagePack backend, values are stored as raw binary rather than base64 strings,
+// transactions use the same short field names as the json backend.
+func Backend() jdb.Backend { return &backend{} }
+
+type backend struct {
+	w   io.Writer
+	buf bytes.Buffer
+	enc *mp.Encoder
+	r   *reader
+	dec *mp.Decoder
+}
+
+func (b *backend) Init(w io.Writer, r io.Reader) error {
+	b.w = w
+	b.r = &reader{Reader: bufio.NewReader(r)}
+	b.enc, b.dec = mp.NewEncoder(&b.buf), mp.NewDecoder(b.r)
+	b.enc.SetCustomStructTag("json")
+	b.enc.UseCompactInts(true)
+	b.dec.SetCustomStructTag("json")
+	return nil
+}
+
+// Flush writes the buffered transaction with a single write, the encoder itself writes every field separately.
+func (b *backend) Flush() error {
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	_, err := b.w.Write(b.buf.Bytes())
+	b.buf.Reset()
+	return err
+}
+
+func (b *backend) Encode(v interface{}) error { return b.enc.Encode(v) }
+
+// Decode returns io.ErrUnexpectedEOF rather than io.EOF for a torn transaction.
+func (b *backend) Decode(v interface{}) error {
+	n := b.r.n
+	err := b.dec.Decode(v)
+	if err == io.EOF && b.r.n != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (b *backend) BackendName() string { return "msgpack" }
+
+func (b *backend) Marshal(in interface{}) ([]byte, error)     { return mp.Marshal(in) }
+func (b *backend) Unmarshal(in []byte, out interface{}) error { return mp.Unmarshal(in, out) }
+
+// reader counts the bytes consumed by the decoder.
+type reader struct {
+	*bufio.Reader
+	n int64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *reader) ReadByte() (byte, error) {
+	c, err := r.Reader.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return c, err
+}
+
+func (r *reader) UnreadByte() error {
+	err := r.Reader.UnreadByte()
+	if err == nil {
+		r.n--
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package jdb
+
+import (
+	"fmt"
+	"os"
+)
+
+// Batch is like Update, but calls made concurrently share a single fsync:
+// calls that arrive while a batch is being committed are committed together in the next one.
+// Every call still gets its own transaction and error, a failing fn only rolls back its own changes.
+//
+// fn may run on another goroutine, after the other functions in the same batch, and must not call Update or Batch.
+func (db *DB) Batch(fn func(tx *Tx) error) error {
+	c := &batchCall{fn: fn, err: make(chan error, 1)}
+
+	db.batchMux.Lock()
+	db.batch = append(db.batch, c)
+	lead := !db.batching
+	db.batching = true
+	db.batchMux.Unlock()
+
+	if lead {
+		go db.commitBatches()
+	}
+
+	err := <-c.err
+	if p, ok := err.(panicked); ok {
+		panic(p.reason)
+	}
+	return err
+}
+
+type batchCall struct {
+	fn  func(tx *Tx) error
+	err chan error
+}
+
+// panicked carries a panic in a batched function back to its caller.
+type panicked struct{ reason interface{} }
+
+func (p panicked) Error() string { return fmt.Sprintf("jdb: batch function panicked: %v", p.reason) }
+
+func (c *batchCall) run(tx *Tx) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = panicked{p}
+		}
+	}()
+	return c.fn(tx)
+}
+
+// commitBatches commits the queued calls until there are none left.
+func (db *DB) commitBatches() {
+	for {
+		db.batchMux.Lock()
+		calls := db.batch
+		if len(calls) > db.opts.MaxBatchSize {
+			calls, db.batch = calls[:db.opts.MaxBatchSize], calls[db.opts.MaxBatchSize:]
+		} else {
+			db.batch = nil
+		}
+		if len(calls) == 0 {
+			db.batching = false
+			db.batchMux.Unlock()
+			return
+		}
+		db.batchMux.Unlock()
+
+		db.commitBatch(calls)
+	}
+}
+
+// commitBatch writes every successful call as a separate transaction and syncs the file once,
+// the new version is only published after the sync.
+func (db *DB) commitBatch(calls []*batchCall) {
+	db.wmux.Lock()
+	defer db.wmux.Unlock()
+
+	var err error
+	switch {
+	case db.readOnly:
+		err = ErrReadOnly
+	case db.isClosed():
+		err = ErrClosed
+	case db.failed != nil:
+		err = db.failed
+	}
+
+	var start int64
+	if err == nil {
+		start, err = db.f.Seek(0, os.SEEK_CUR)
+	}
+	if err != nil {
+		for _, c := range calls {
+			c.err <- err
+		}
+		return
+	}
+
+	var (
+		root = db.snapshot()
+		idx  = db.maxIndex
+		pos  = start
+		ok   = calls[:0:0]
+	)
+
+	for _, c := range calls {
+		tx := db.getTx(true)
+		tx.realBucket = root // sees the calls before it in the batch
+
+		err := c.run(tx)
+		if err == nil {
+			var end int64
+			if end, err = db.appendTx(tx.tmpBucket, idx, pos); err == nil {
+				pos = end
+			}
+		}
+
+		if err != nil {
+			db.addRollbacks(1)
+			c.err <- err
+		} else {
+			root = db.applyTx(tx.tmpBucket, root)
+			idx++
+			ok = append(ok, c)
+		}
+		db.putTx(tx)
+	}
+
+	if len(ok) == 0 {
+		return
+	}
+
+	if err = db.syncTx(); err != nil {
+		db.truncate(start)
+		db.addRollbacks(len(ok))
+	} else {
+		db.root.Store(root)
+		db.maxIndex = idx
+		db.addCommits(len(ok))
+	}
+
+	for _, c := range ok {
+		c.err <- err
+	}
+}
@@ -0,0 +1,57 @@
+package jdb
+
+import "time"
+
+// TxInfo describes a transaction read from the file.
+type TxInfo struct {
+	Index   uint64
+	Time    time.Time
+	Compact bool // true if the transaction is a compacted snapshot of the whole database
+}
+
+// ChangeSet is a view of the changes a single transaction makes to a bucket,
+// it allows Opts.ReplayFilter to inspect or rewrite transactions while they are loaded.
+type ChangeSet struct {
+	b *bucket
+}
+
+// Keys returns the modified keys in this bucket, including deleted ones.
+func (cs *ChangeSet) Keys() []string {
+	out := make([]string, 0, len(cs.b.Data))
+	for k := range cs.b.Data {
+		out = append(out, k)
+	}
+	return out
+}
+
+// Get returns the new value of key and whether it was modified, a nil value means the key got deleted.
+func (cs *ChangeSet) Get(key string) (v Value, ok bool) {
+	v, ok = cs.b.Data[key]
+	return
+}
+
+// Set replaces the new value of key, a nil val turns the change into a deletion.
+func (cs *ChangeSet) Set(key string, val Value) { cs.b.Set(key, val) }
+
+// Remove drops the change to key, leaving the old value intact.
+func (cs *ChangeSet) Remove(key string) { cs.b.Delete(key) }
+
+// Buckets returns the names of the modified child buckets, including deleted ones.
+func (cs *ChangeSet) Buckets() []string {
+	out := make([]string, 0, len(cs.b.Buckets))
+	for bn := range cs.b.Buckets {
+		out = append(out, bn)
+	}
+	return out
+}
+
+// Bucket returns the changes to the child bucket name, or nil if it wasn't modified or got deleted.
+func (cs *ChangeSet) Bucket(name string) *ChangeSet {
+	if b := cs.b.Buckets[name]; b != nil {
+		return &ChangeSet{b}
+	}
+	return nil
+}
+
+// RemoveBucket drops all the changes to the child bucket name, including its deletion.
+func (cs *ChangeSet) RemoveBucket(name string) { cs.b.DeleteBucket(name) }
@@ -0,0 +1,104 @@
+package jdb
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Convert rewrites the database file at srcPath, written with srcBE, to dstPath using dstBE.
+// If keepHistory is true every transaction is copied as is, otherwise they are collapsed into a single snapshot like Compact does.
+// Files with checksums are detected and the new file will have checksums as well.
+// If the source file has a header, srcBE must match the backend recorded in it.
+// The new file is written to a temp file and renamed to dstPath, which may be the same as srcPath.
+func Convert(srcPath string, srcBE func() Backend, dstPath string, dstBE func() Backend, keepHistory bool) (err error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// a database that's open for writing can't be converted
+	if err = lockFile(src, false, 0); err != nil {
+		return err
+	}
+
+	sh, err := readFileHeader(src)
+	if err != nil {
+		return err
+	}
+
+	var checksum bool
+	if sh != nil {
+		checksum = sh.Checksum
+	} else {
+		magic := make([]byte, len(frameMagic))
+		n, _ := src.ReadAt(magic, 0)
+		checksum = n == len(magic) && string(magic) == frameMagic
+	}
+
+	sdb := newMemDB(srcPath, &Opts{Backend: srcBE, Checksum: checksum})
+	if sh != nil {
+		if err = sh.check(sdb.be); err != nil {
+			return err
+		}
+		sdb.hdr = sh
+	}
+	if _, err = initBackend(sdb.be, ioutil.Discard, src, checksum); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dstPath), "jdb-convert")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	be := dstBE()
+	_, fw, err := initFile(f, be, checksum, sdb.created())
+	if err != nil {
+		return err
+	}
+
+	if keepHistory {
+		err = copyTxs(be, fw, sdb.be, -1)
+	} else if err = sdb.replay(nil); err == nil {
+		err = encodeTx(be, fw, &fileTx{
+			Index:     sdb.maxIndex + 1,
+			TS:        time.Now().Unix(),
+			Changeset: sdb.snapshot().toBucket(),
+			Compact:   true,
+		})
+	}
+
+	if err != nil {
+		if de, ok := err.(*decodeError); ok {
+			err = de.err
+		}
+		return err
+	}
+
+	if c, ok := be.(io.Closer); ok {
+		if err = c.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), dstPath)
+}
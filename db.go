@@ -1,6 +1,7 @@
 package jdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,58 +20,119 @@ var (
 	ErrClosed             = errors.New("db is closed, you may access read-only operations")
 	ErrMissingMarshaler   = errors.New("missing marshaler")
 	ErrMissingUnmarshaler = errors.New("missing unmarshaler")
+	ErrHistoryCompacted   = errors.New("the requested point in history was compacted")
+	ErrTxClosed           = errors.New("tx is closed")
+	ErrTxManaged          = errors.New("tx is managed by Read, Update or Batch and can't be committed or rolled back")
+	ErrSavepointReleased  = errors.New("savepoint was released or rolled back")
 )
 
 //type Bucket map[string]Value
 
 type DB struct {
-	mux sync.RWMutex
-	f   *os.File
+	mux  sync.RWMutex
+	wmux wlock // serializes writers
+	f    *os.File
+	fw   *frameWriter
 
-	root bucket
+	root atomic.Value // *node, the latest committed version of the tree
 
 	maxIndex uint64
 
 	txPool sync.Pool
 
-	opts  Opts
-	be    Backend
-	stats struct {
-		Rollbacks int64
-		Commits   int64
-	}
+	batchMux sync.Mutex
+	batch    []*batchCall
+	batching bool // a goroutine is committing the queued batch calls
+
+	dirty    bool  // there are commits that weren't synced yet, guarded by wmux
+	syncErr  error // the last error of the background sync, guarded by wmux
+	failed   error // set if the file couldn't be restored after a failed write, see truncate, guarded by wmux
+	syncStop chan struct{}
+	syncWg   sync.WaitGroup
+
+	opts     Opts
+	be       Backend
+	readOnly bool
+	name     string
+	hdr      *Header
+	follower *follower
+	recovery *RecoveryReport
+
+	commits   int64 // updated atomically
+	rollbacks int64 // updated atomically
+	size      int64 // the size of the file, updated atomically
+	txs       int64 // transactions since the last compaction, updated atomically
+
+	statsMux sync.Mutex
+	stats    Stats // the compaction stats, see DB.Stats
+
+	compactedAt time.Time // guarded by wmux
+	overhead    float64   // the file size of the last compaction divided by the live size, guarded by wmux
+	compactKick chan struct{}
+	compactStop chan struct{}
+	compactorWg sync.WaitGroup
 }
 
 func New(fp string, opts *Opts) (*DB, error) {
-	f, err := os.OpenFile(fp, os.O_CREATE|os.O_RDWR, 0600)
+	o := opts.withDefaults()
+	flag := os.O_CREATE | os.O_RDWR
+	if o.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := openLocked(fp, flag, !o.ReadOnly, o.LockTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	if opts == nil {
-		opts = &Opts{}
+	db := &DB{
+		wmux:     newWLock(),
+		opts:     o,
+		f:        f,
+		name:     fp,
+		readOnly: o.ReadOnly,
 	}
-	if opts.Backend == nil {
-		opts.Backend = JSONBackend
+	db.be = db.opts.Backend()
+	db.root.Store(&node{})
+	db.txPool.New = func() interface{} { return db.createTx() }
+
+	// closing the file releases the lock
+	if err = db.open(); err != nil {
+		db.f.Close()
+		return nil, err
 	}
+	db.startSyncer()
+	db.startCompactor()
+	return db, nil
+}
 
-	db := &DB{
-		opts: *opts,
-		f:    f,
-		be:   opts.Backend(),
+func (db *DB) open() (err error) {
+	if err = db.initHeader(); err != nil {
+		return err
 	}
 
-	if err = db.be.Init(f, f); err != nil {
-		return nil, err
+	// backends may write a header of their own to an empty file
+	var w io.Writer = db.f
+	if db.readOnly {
+		w = ioutil.Discard
+	}
+	if db.fw, err = initBackend(db.be, w, db.f, db.opts.Checksum); err != nil {
+		return err
 	}
-	db.txPool.New = func() interface{} { return db.createTx() }
 
 	if err = db.load(); err != nil {
-		return nil, err
+		return err
 	}
 	db.maxIndex++
-	_, err = db.f.Seek(0, os.SEEK_END)
-	return db, err
+	size, err := db.f.Seek(0, os.SEEK_END)
+	atomic.StoreInt64(&db.size, size)
+	return err
+}
+
+// OpenReadOnly is a shorthand for New with Opts.ReadOnly set.
+func OpenReadOnly(fp string, opts *Opts) (*DB, error) {
+	o := opts.withDefaults()
+	o.ReadOnly = true
+	return New(fp, &o)
 }
 
 func (db *DB) load() error {
@@ -82,34 +145,86 @@ func (db *DB) load() error {
 		return nil
 	}
 
-	for {
+	err = db.replay(nil)
+	if de, ok := err.(*decodeError); ok {
+		return db.recover(de, st.Size())
+	}
+	return err
+}
+
+// replay decodes transactions from the backend and applies them to the root bucket,
+// it stops at EOF or at the first transaction past the point selected by ro.
+// Decoding errors are returned as a *decodeError, the transactions before it are still applied.
+func (db *DB) replay(ro *ReplayOpts) (err error) {
+	root := db.snapshot()
+	defer func() { db.root.Store(root) }()
+
+	for n := 0; ; n++ {
 		var tx fileTx
-		if err = db.be.Decode(&tx); err != nil {
+		if err := db.be.Decode(&tx); err != nil {
 			if err == io.EOF {
-				err = nil
+				return nil
+			}
+			return &decodeError{err, n}
+		}
+
+		if ro.after(&tx) {
+			if n == 0 && tx.Compact {
+				return ErrHistoryCompacted
 			}
+			return nil
+		}
+
+		if root, err = db.replayTx(&tx, root); err != nil {
 			return err
 		}
+	}
+}
+
+// replayTx returns root with a transaction read from the file applied, unless Opts.ReplayFilter drops it.
+func (db *DB) replayTx(tx *fileTx, root *node) (*node, error) {
+	if fn := db.opts.ReplayFilter; fn != nil {
+		if tx.Changeset == nil {
+			tx.Changeset = &bucket{}
+		}
+		keep, err := fn(TxInfo{tx.Index, time.Unix(tx.TS, 0), tx.Compact}, &ChangeSet{tx.Changeset})
+		if err != nil {
+			return root, err
+		}
+		if !keep {
+			db.maxIndex = tx.Index
+			return root, nil
+		}
+	}
 
-		db.applyTx(tx.Changeset, &db.root)
-		db.maxIndex = tx.Index
+	if tx.Compact {
+		root = nil
+		atomic.StoreInt64(&db.txs, 0)
+	} else {
+		atomic.AddInt64(&db.txs, 1)
 	}
+	root = db.applyTx(tx.Changeset, root)
+	db.maxIndex = tx.Index
+	return root, nil
 }
 
 func (db *DB) createTx() *Tx {
-	return &Tx{
+	tx := &Tx{
 		BucketTx: BucketTx{
 			db: db,
 
-			tmpBucket:  &bucket{},
-			realBucket: &db.root,
+			tmpBucket: &bucket{},
 		},
 	}
+	tx.tx = tx
+	return tx
 }
 
+// getTx returns a pooled transaction for Read, Update and Batch.
 func (db *DB) getTx(rw bool) *Tx {
 	tx := db.txPool.Get().(*Tx)
-	tx.rw = rw
+	tx.rw, tx.managed = rw, true
+	tx.realBucket = db.snapshot()
 	return tx
 }
 
@@ -121,90 +236,225 @@ func (db *DB) putTx(tx *Tx) {
 		for k := range tb.Data {
 			delete(tb.Data, k)
 		}
+		tb.Seq = 0
 	}
+	tx.realBucket, tx.ctx = nil, nil
+	tx.releaseSavepoints()
 	db.txPool.Put(tx)
 }
 
-func (db *DB) applyTx(src, dst *bucket) {
-	for k, v := range src.Data {
-		if v == nil {
-			dst.Delete(k)
-		} else {
-			if db.opts.CopyOnSet {
-				v = v.Copy()
+// snapshot returns the current version of the tree, it never changes.
+func (db *DB) snapshot() *node { return db.root.Load().(*node) }
+
+// backend returns the current backend, Compact, Rekey and Follow replace it under mux.
+func (db *DB) backend() Backend {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.be
+}
+
+// applyTx returns a new version of dst with the changes in src, dst itself isn't modified.
+func (db *DB) applyTx(src *bucket, dst *node) *node {
+	return dst.apply(src, &edit{}, db.opts.CopyOnSet)
+}
+
+// initBackend initializes be with w and r, wrapping them in frames if checksum is true.
+func initBackend(be Backend, w io.Writer, r io.Reader, checksum bool) (*frameWriter, error) {
+	if !checksum {
+		return nil, be.Init(w, r)
+	}
+	fw := &frameWriter{w: w}
+	return fw, be.Init(fw, &frameReader{r: r})
+}
+
+// encodeTx encodes and flushes tx, fw is nil unless checksums are enabled.
+func encodeTx(be Backend, fw *frameWriter, tx *fileTx) (err error) {
+	if fw != nil {
+		defer func() {
+			if err == nil {
+				err = fw.writeFrame(tx.Index, tx.TS)
+			} else {
+				fw.reset()
 			}
-			dst.Set(k, v)
-		}
+		}()
 	}
 
-	for bn, b := range src.Buckets {
-		if b == nil {
-			dst.DeleteBucket(bn)
-		} else {
-			db.applyTx(b, dst.Bucket(bn))
-		}
+	if err = be.Encode(tx); err != nil {
+		return err
 	}
+
+	return be.Flush()
 }
 
 func (db *DB) writeTx(tx *Tx) error {
+	err := tx.Context().Err()
+	if err == nil {
+		err = db.failed
+	}
+	if err != nil {
+		db.addRollbacks(1)
+		return err
+	}
+
 	curPos, err := db.f.Seek(0, os.SEEK_CUR)
 	if err != nil {
 		return err
 	}
 
-	if err := db.be.Encode(&fileTx{
-		Index:     db.maxIndex,
-		TS:        time.Now().Unix(),
-		Changeset: tx.tmpBucket,
-	}); err != nil {
-		db.stats.Rollbacks++
-		db.f.Truncate(curPos)
+	if _, err = db.appendTx(tx.tmpBucket, db.maxIndex, curPos); err == nil {
+		if err = db.syncTx(); err != nil {
+			db.truncate(curPos)
+		}
+	}
+
+	if err != nil {
+		db.addRollbacks(1)
 		return err
 	}
 
-	if err := db.be.Flush(); err != nil {
-		db.stats.Rollbacks++
-		db.f.Truncate(curPos)
+	db.root.Store(db.applyTx(tx.tmpBucket, tx.realBucket))
+	db.maxIndex++
+	db.addCommits(1)
+	return nil
+}
+
+// appendTx writes a transaction with the changes in cs at pos without syncing the file and returns the new end of the file,
+// on error the file is truncated back to pos.
+func (db *DB) appendTx(cs *bucket, idx uint64, pos int64) (int64, error) {
+	err := encodeTx(db.be, db.fw, &fileTx{
+		Index:     idx,
+		TS:        time.Now().Unix(),
+		Changeset: cs,
+	})
+
+	var end int64
+	if err == nil {
+		end, err = db.f.Seek(0, os.SEEK_CUR)
+	}
+	if err != nil {
+		db.truncate(pos)
+		return 0, err
+	}
+	atomic.StoreInt64(&db.size, end)
+	return end, nil
+}
+
+// truncate drops the transactions written after pos, it must be called with wmux held.
+// Backends like GCMBackend and AESBackend keep state about what they wrote, so the backend is replaced with one
+// that read what is left of the file. If that fails, writes return the error until Compact rewrites the file.
+func (db *DB) truncate(pos int64) {
+	err := db.f.Truncate(pos)
+	if err == nil {
+		err = db.resetBackend()
+	}
+	if err != nil {
+		db.failed = err
+	}
+	atomic.StoreInt64(&db.size, pos)
+}
+
+// resetBackend replaces the backend with a new one that read the whole file.
+func (db *DB) resetBackend() error {
+	if _, err := db.f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if _, err := readFileHeader(db.f); err != nil {
 		return err
 	}
 
-	if err := db.f.Sync(); err != nil {
-		db.stats.Rollbacks++
-		db.f.Truncate(curPos)
+	be := db.opts.Backend()
+	fw, err := initBackend(be, db.f, db.f, db.opts.Checksum)
+	if err != nil {
+		return err
+	}
+	for {
+		var tx fileTx
+		if err = be.Decode(&tx); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if _, err = db.f.Seek(0, os.SEEK_END); err != nil {
 		return err
 	}
 
-	db.applyTx(tx.tmpBucket, &db.root)
-	db.stats.Commits++
-	db.maxIndex++
+	db.mux.Lock()
+	db.be, db.fw = be, fw
+	db.mux.Unlock()
 	return nil
 }
 
-func (db *DB) Read(fn func(tx *Tx) error) error {
+// Read calls fn with a read-only transaction, it sees the database as it was when Read was called
+// and neither waits for writers nor blocks them.
+func (db *DB) Read(fn func(tx *Tx) error) error { return db.ReadContext(context.Background(), fn) }
+
+// ReadContext is like Read, but fn isn't called if ctx is already done, tx.Context returns ctx.
+// Readers never wait for a lock, fn should check ctx itself if it can run for long.
+func (db *DB) ReadContext(ctx context.Context, fn func(tx *Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	tx := db.getTx(false)
-	db.mux.RLock()
-	defer func() {
-		db.mux.RUnlock()
-		db.putTx(tx)
-	}()
+	tx.ctx = ctx
+	defer db.putTx(tx)
 	return fn(tx)
 }
 
+// Begin starts a transaction that must be closed with Commit or Rollback, like with Update only one writable transaction
+// can be open at a time, Begin(true) waits for it to be closed and so does Close.
+// Read-only transactions see the database as it was when they started and don't block anything.
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	if !writable {
+		tx := db.createTx()
+		tx.realBucket = db.snapshot()
+		return tx, nil
+	}
+
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	db.wmux.Lock()
+	if db.isClosed() {
+		db.wmux.Unlock()
+		return nil, ErrClosed
+	}
+
+	// Begin transactions aren't pooled, so using one after it's closed can't affect another
+	tx := db.createTx()
+	tx.rw, tx.realBucket = true, db.snapshot()
+	return tx, nil
+}
+
 // View is an alias for Read, to simplify moving code from bolt.
 func (db *DB) View(fn func(tx *Tx) error) error { return db.Read(fn) }
 
-func (db *DB) Update(fn func(tx *Tx) error) error {
+// Update calls fn with a read-write transaction and commits it if fn returns nil,
+// only one Update runs at a time but readers are never blocked by it.
+func (db *DB) Update(fn func(tx *Tx) error) error { return db.UpdateContext(context.Background(), fn) }
+
+// UpdateContext is like Update, but it stops waiting for the current writer and returns ctx.Err() once ctx is done,
+// tx.Context returns ctx and the transaction isn't committed if ctx is done by the time fn returns.
+func (db *DB) UpdateContext(ctx context.Context, fn func(tx *Tx) error) error {
+	if err := db.wmux.LockContext(ctx); err != nil {
+		return err
+	}
+	// the snapshot must be taken after the previous writer committed
 	tx := db.getTx(true)
-	db.mux.Lock()
+	tx.ctx = ctx
 	defer func() {
-		db.mux.Unlock()
+		db.wmux.Unlock()
 		db.putTx(tx)
 	}()
+	if db.readOnly {
+		return ErrReadOnly
+	}
 	if db.isClosed() {
 		return ErrClosed
 	}
 	if err := fn(tx); err != nil {
-		db.stats.Rollbacks++
+		db.addRollbacks(1)
 		return err
 	}
 	return db.writeTx(tx)
@@ -213,20 +463,18 @@ func (db *DB) Update(fn func(tx *Tx) error) error {
 // Get is a shorthand access a value in an optional bucket chain.
 //	Example: v := db.Get("name", "users", "user-id-1")
 func (db *DB) Get(key string, bucket ...string) Value {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-	b := &db.root
+	b := db.snapshot()
 	for _, bn := range bucket {
-		if b = b.Buckets[bn]; b == nil {
+		if b = b.bucket(bn); b == nil {
 			return nil
 		}
 	}
-	return b.Get(key)
+	return b.get(key)
 }
 
 func (db *DB) GetObject(key string, out interface{}, bucket ...string) error {
 	v := db.Get(key, bucket...)
-	return db.be.Unmarshal(v, out)
+	return db.backend().Unmarshal(v, out)
 }
 
 // Set is a shorthand for an Update call with an optional Bucket chain.
@@ -243,7 +491,7 @@ func (db *DB) Set(key string, val []byte, bucket ...string) error {
 }
 
 func (db *DB) SetObject(key string, val interface{}, bucket ...string) error {
-	v, err := db.be.Marshal(val)
+	v, err := db.backend().Marshal(val)
 	if err != nil {
 		return err
 	}
@@ -255,71 +503,173 @@ func (db *DB) isClosed() bool {
 }
 
 func (db *DB) Close() error {
+	if db.follower != nil {
+		db.follower.stop()
+	}
+	db.stopCompactor()
+	db.stopSyncer()
+	db.wmux.Lock()
 	db.mux.Lock()
 	err := db.close()
+	if err == nil {
+		err, db.syncErr = db.syncErr, nil
+	}
 	db.mux.Unlock()
+	db.wmux.Unlock()
 	return err
 }
 
 func (db *DB) close() error {
+	if db.f == nil {
+		return nil
+	}
 	if c, ok := db.be.(io.Closer); ok {
 		if err := c.Close(); err != nil {
 			return err
 		}
 	}
+	if err := db.flush(); err != nil {
+		return err
+	}
 	return db.f.Close()
 }
 
-func (db *DB) Name() string { return db.f.Name() }
+func (db *DB) Name() string { return db.name }
 
 // Compact compacts the database, transactions will be lost, however the counter will still be valid.
-func (db *DB) Compact() error {
-	db.mux.Lock()
-	f, err := ioutil.TempFile(filepath.Dir(db.f.Name()), "jdb-compact")
+// If Opts.ArchiveDir is set, the old transaction log is archived first.
+func (db *DB) Compact() error { return db.compact(nil) }
+
+// Rekey is like Compact but writes the new file with newBackend, which is used from then on.
+// It can rotate encryption keys or switch between formats, the database keeps serving reads while it runs.
+func (db *DB) Rekey(newBackend func() Backend) error { return db.compact(newBackend) }
+
+// Snapshot writes the contents of the database to w, encoded with the Marshal method of the backend.
+// Unlike the file written by Compact it holds no timestamps or transaction indexes, so with a deterministic
+// backend like cbor.Backend, databases with the same contents write the same bytes and can be compared by hash.
+func (db *DB) Snapshot(w io.Writer) error {
+	b, err := db.backend().Marshal(db.snapshot().toBucket())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (db *DB) compact(newBackend func() Backend) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// wmux blocks writers and other compactions, readers are only blocked while the files are swapped.
+	db.wmux.Lock()
+	defer db.wmux.Unlock()
+
+	if db.isClosed() {
+		return ErrClosed
+	}
+
+	return db.compactLocked(newBackend, false)
+}
+
+// compactLocked must be called with wmux held, the result is recorded in the stats.
+func (db *DB) compactLocked(newBackend func() Backend, auto bool) error {
+	cs := CompactStats{Time: time.Now(), Auto: auto, Before: atomic.LoadInt64(&db.size)}
+	err := db.rewrite(newBackend)
+	cs.Duration, cs.After, cs.Err = time.Since(cs.Time), atomic.LoadInt64(&db.size), err
+
+	db.statsMux.Lock()
+	db.stats.Compactions++
+	if auto {
+		db.stats.AutoCompactions++
+	}
+	db.stats.LastCompact = cs
+	db.statsMux.Unlock()
+	return err
+}
+
+// rewrite replaces the file with a snapshot of the database.
+func (db *DB) rewrite(newBackend func() Backend) error {
+	if newBackend == nil {
+		newBackend = db.opts.Backend
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(db.name), "jdb-compact")
+	if err != nil {
+		return err
+	}
 
 	defer func() {
-		db.mux.Unlock()
 		if err != nil {
 			f.Close()
 			os.Remove(f.Name())
 		}
 	}()
 
-	if err != nil {
-		return err
-	}
-
-	cp := db.opts.Backend()
+	cp := newBackend()
 
-	if err = cp.Init(f, f); err != nil {
+	hdr, fw, err := initFile(f, cp, db.opts.Checksum, db.created())
+	if err != nil {
 		return err
 	}
 
-	if err = cp.Encode(&fileTx{
+	// wmux keeps the snapshot current until the files are swapped
+	root := db.snapshot()
+	if err = encodeTx(cp, fw, &fileTx{
 		Index:     db.maxIndex,
 		TS:        time.Now().Unix(),
-		Changeset: &db.root,
+		Changeset: root.toBucket(),
 		Compact:   true,
 	}); err != nil {
 		return err
 	}
 
-	if err = cp.Flush(); err != nil {
+	if err = f.Sync(); err != nil {
 		return err
 	}
 
-	if err = f.Sync(); err != nil {
+	size, err := f.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+
+	if db.opts.ArchiveDir != "" {
+		if err = db.archive(); err != nil {
+			return err
+		}
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	// the new file was already synced
+	db.dirty = false
+	if cerr := db.swap(f, cp, fw); cerr != nil {
+		return cerr
+	}
+
+	db.opts.Backend, db.hdr = newBackend, hdr
+	db.compacted(size, root.size)
+	return nil
+}
+
+// swap replaces the database file with f, which must be in the same directory.
+func (db *DB) swap(f *os.File, be Backend, fw *frameWriter) error {
+	// lock the new file before it becomes visible, other processes waiting for the old one will retry with it
+	if err := lockFile(f, true, 0); err != nil {
+		f.Close()
 		return err
 	}
 
 	db.close()
 
-	if err := os.Rename(f.Name(), db.f.Name()); err != nil {
+	if err := os.Rename(f.Name(), db.name); err != nil {
 		f.Close()
-		return &CompactError{f.Name(), db.f.Name(), err}
+		return &CompactError{f.Name(), db.name, err}
 	}
 
-	db.f, db.be = f, cp
+	db.f, db.be, db.fw = f, be, fw
+	db.failed = nil
 	return nil
 }
 
@@ -1,19 +1,31 @@
 package jdb_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"flag"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"crypto/sha256"
 	"crypto/sha512"
 
 	"github.com/OneOfOne/jdb"
+	"github.com/OneOfOne/jdb/backends/cbor"
+	"github.com/OneOfOne/jdb/backends/compress"
 	"github.com/OneOfOne/jdb/backends/crypto"
+	"github.com/OneOfOne/jdb/backends/msgpack"
 	"github.com/boltdb/bolt"
 )
 
@@ -45,6 +57,22 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// tmpPath returns a path in the temp dir, removing anything left there by a previous run.
+func tmpPath(name string) string {
+	fp := filepath.Join(tmpDir, name)
+	os.RemoveAll(fp)
+	return fp
+}
+
+// headerSize returns the size of the file header of fp.
+func headerSize(tb testing.TB, fp string) int {
+	h, err := jdb.Probe(fp)
+	if err != nil {
+		tb.Fatal(fp, err)
+	}
+	return 15 + len(h.Backend)
+}
+
 func getJDB(tb testing.TB, fp string, be func() jdb.Backend) *jdb.DB {
 	db, err := jdb.New(fp, &jdb.Opts{Backend: be})
 	if err != nil {
@@ -53,113 +81,2120 @@ func getJDB(tb testing.TB, fp string, be func() jdb.Backend) *jdb.DB {
 	return db
 }
 
-func TestDB(t *testing.T) {
-	fp := filepath.Join(tmpDir, "gzip-json.jdb")
-	db := getJDB(t, fp, jdb.GZipLevelJSONBackend(9))
+func TestDB(t *testing.T) {
+	fp := filepath.Join(tmpDir, "gzip-json.jdb")
+	db := getJDB(t, fp, jdb.GZipLevelJSONBackend(9))
+
+	//defer os.RemoveFile(db.f.Name())
+	db.Update(func(tx *jdb.Tx) error {
+		return tx.Set("a", jdb.Value("a"))
+	})
+
+	if err := db.Read(func(tx *jdb.Tx) error {
+		if tx.Get("a") == nil {
+			t.Error("couldn't get a")
+		}
+		return tx.Set("a", []byte("a"))
+	}); err != jdb.ErrReadOnly {
+		t.Fatal("expected ErrReadOnly, got", err)
+	}
+
+	db.Update(func(tx *jdb.Tx) error {
+		tx.Set("b", []byte("b"))
+		return tx.Delete("a")
+	})
+
+	db.Read(func(tx *jdb.Tx) error {
+		if tx.Get("a") != nil {
+			t.Error("got a when we shouldn't have")
+		}
+		return nil
+	})
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	var err error
+	if db, err = jdb.New(fp, &jdb.Opts{Backend: jdb.GZipJSONBackend}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Update(func(tx *jdb.Tx) error {
+		tx.Bucket("parent").Bucket("child").Set("the punisher", jdb.Value("coolest hero"))
+		return tx.Set("c", []byte("c"))
+	})
+
+	db.Read(func(tx *jdb.Tx) error {
+		if tx.Get("b") == nil {
+			t.Error("coudln't load b :(")
+		}
+		b := tx.Bucket("parent").Bucket("child")
+		if b.Get("the punisher") == nil {
+			t.Error("NOOOOOOO")
+		}
+		return nil
+	})
+
+	db.Close()
+}
+
+func TestCryptoBackend(t *testing.T) {
+	fp := filepath.Join(tmpDir, "crypto-gzip-json.jdb")
+	opts := &jdb.Opts{Backend: crypto.AESBackend(jdb.GZipJSONBackend, key[:])}
+	db, err := jdb.New(fp, opts)
+	if err != nil {
+		t.Fatal(fp, err)
+	}
+	for i := 0; i < 10; i++ {
+		bn := "bucket-" + strconv.Itoa(i)
+		if err := db.Update(func(tx *jdb.Tx) error {
+			b := tx.Bucket(bn)
+			for i := 0; i < 100; i++ {
+				kn := strconv.Itoa(i)
+				b.Set(kn, jdb.Value(kn))
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	db, err = jdb.New(fp, opts)
+	if err != nil {
+		t.Fatal(fp, err)
+	}
+	db.Read(func(tx *jdb.Tx) error {
+		for i := 0; i < 10; i++ {
+			bn := "bucket-" + strconv.Itoa(i)
+			b := tx.Bucket(bn)
+			for i := 0; i < 100; i++ {
+				kn := strconv.Itoa(i)
+				if v := b.Get(kn); v.String() != kn {
+					t.Errorf("expected %s, got %s", kn, v)
+				}
+			}
+		}
+		return nil
+	})
+	db.Close()
+}
+
+func TestGCMBackend(t *testing.T) {
+	fp := tmpPath("gcm-json.jdb")
+	be := crypto.GCMBackend(jdb.JSONBackend, key[:])
+	db := getJDB(t, fp, be)
+	for i := 0; i < 3; i++ {
+		db.Set(strconv.Itoa(i), jdb.Value("v"))
+	}
+	db.Close()
+
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, b := b[:headerSize(t, fp)], b[headerSize(t, fp):]
+
+	check := func(b []byte, rec uint64) {
+		if err := ioutil.WriteFile(fp, append(hdr[:len(hdr):len(hdr)], b...), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := jdb.New(fp, &jdb.Opts{Backend: be})
+		var ae *crypto.AuthError
+		if !errors.As(err, &ae) || !errors.Is(err, crypto.ErrAuthFailed) {
+			t.Fatalf("expected an *AuthError, got %v", err)
+		}
+		if ae.Record != rec {
+			t.Errorf("expected record %d, got %d", rec, ae.Record)
+		}
+	}
+
+	// every record starts with its size
+	off := 4 + int(binary.LittleEndian.Uint32(b))
+	tampered := append([]byte(nil), b...)
+	tampered[off+20] ^= 1
+	check(tampered, 1)
+
+	check(b[:len(b)-5], 2)
+
+	// swap the first two records
+	off2 := off + 4 + int(binary.LittleEndian.Uint32(b[off:]))
+	swapped := append(append(append([]byte(nil), b[off:off2]...), b[:off]...), b[off2:]...)
+	check(swapped, 0)
+}
+
+func TestPassphrase(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		fn     func(be func() jdb.Backend, pass []byte) func() jdb.Backend
+		raw    func(be func() jdb.Backend, key []byte) func() jdb.Backend
+		header string
+	}{
+		{"aes", crypto.AESPassphraseBackend, crypto.AESBackend, "aes-cfb+argon2id>gzip>json"},
+		{"gcm", crypto.GCMPassphraseBackend, crypto.GCMBackend, "aes-gcm+argon2id>gzip>json"},
+	} {
+		name, fn := c.name, c.fn
+		fp := tmpPath("passphrase-" + name + ".jdb")
+		be := fn(jdb.GZipJSONBackend, []byte("correct horse battery staple"))
+		db := getJDB(t, fp, be)
+		db.Set("a", jdb.Value("a"))
+		db.Close()
+
+		db = getJDB(t, fp, be)
+		db.Set("b", jdb.Value("b"))
+		db.Close()
+
+		db = getJDB(t, fp, be)
+		if a, b := db.Get("a").String(), db.Get("b").String(); a != "a" || b != "b" {
+			t.Errorf("%s: expected a and b, got %q and %q", name, a, b)
+		}
+		db.Close()
+
+		bad := fn(jdb.GZipJSONBackend, []byte("hunter2"))
+		if _, err := jdb.New(fp, &jdb.Opts{Backend: bad}); err != crypto.ErrBadPassphrase {
+			t.Errorf("%s: expected ErrBadPassphrase, got %v", name, err)
+		}
+
+		// the header records that the key is derived from a passphrase, so a raw key can't open the file
+		if h, err := jdb.Probe(fp); err != nil || h.Backend != c.header {
+			t.Errorf("%s: unexpected header: %+v %v", name, h, err)
+		}
+		raw := c.raw(jdb.GZipJSONBackend, key[:])
+		if _, err := jdb.New(fp, &jdb.Opts{Backend: raw, Recovery: jdb.RecoveryTruncateTorn}); !errors.Is(err, jdb.ErrBackendMismatch) {
+			t.Errorf("%s: expected ErrBackendMismatch, got %v", name, err)
+		}
+
+		// the KDF parameters come from the file: time, memory and threads are at 5, 9 and 13
+		b, err := ioutil.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs := headerSize(t, fp)
+		for _, patch := range []func(h []byte){
+			func(h []byte) { binary.LittleEndian.PutUint32(h[5:], 0) },
+			func(h []byte) { binary.LittleEndian.PutUint32(h[9:], 1<<31) },
+			func(h []byte) { binary.LittleEndian.PutUint32(h[9:], 1) },
+			func(h []byte) { h[13] = 0 },
+		} {
+			h := append([]byte(nil), b...)
+			patch(h[hs:])
+			if err = ioutil.WriteFile(fp, h, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := jdb.New(fp, &jdb.Opts{Backend: be}); err != crypto.ErrBadHeader {
+				t.Errorf("%s: expected ErrBadHeader, got %v", name, err)
+			}
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	fp := tmpPath("rekey.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+
+	for i := 0; i < 100; i++ {
+		db.Set(strconv.Itoa(i), jdb.Value(strconv.Itoa(i)), "bucket")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if v := db.Get("42", "bucket").String(); v != "42" {
+				t.Errorf("expected 42, got %q", v)
+				return
+			}
+		}
+	}()
+
+	// the object helpers use the backend that Rekey swaps
+	objDone := make(chan struct{})
+	go func() {
+		defer close(objDone)
+		for i := 0; i < 100; i++ {
+			var a, b int
+			if err := db.GetObject("42", &a, "bucket"); err != nil || a != 42 {
+				t.Errorf("expected 42, got %d %v", a, err)
+				return
+			}
+			db.Read(func(tx *jdb.Tx) error { return tx.Bucket("bucket").GetObject("42", &b) })
+			if err := db.SetObject("obj", i); err != nil {
+				t.Error(err)
+				return
+			}
+			db.Update(func(tx *jdb.Tx) error { return tx.SetObject("txObj", i) })
+		}
+	}()
+
+	gcm := crypto.GCMBackend(jdb.GZipJSONBackend, key[:])
+	for _, be := range []func() jdb.Backend{
+		jdb.GZipJSONBackend,
+		crypto.AESBackend(jdb.JSONBackend, key[:]),
+		gcm,
+	} {
+		if err := db.Rekey(be); err != nil {
+			t.Fatal(err)
+		}
+		db.Set("last", jdb.Value("x"))
+	}
+	<-done
+	<-objDone
+	db.Close()
+
+	if _, err := jdb.New(fp, &jdb.Opts{Backend: jdb.JSONBackend}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	db = getJDB(t, fp, gcm)
+	defer db.Close()
+	if v := db.Get("99", "bucket").String(); v != "99" {
+		t.Errorf("expected 99, got %q", v)
+	}
+	if v := db.Get("last").String(); v != "x" {
+		t.Errorf("expected x, got %q", v)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	for _, sum := range []bool{false, true} {
+		fp := tmpPath("convert-" + strconv.FormatBool(sum) + ".jdb")
+		db, err := jdb.New(fp, &jdb.Opts{Checksum: sum})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 5; i++ {
+			db.Set("i", jdb.Value(strconv.Itoa(i)))
+		}
+		db.Close()
+
+		prod := crypto.AESBackend(jdb.GZipJSONBackend, key[:])
+		if err = jdb.Convert(fp, jdb.JSONBackend, fp+".prod", prod, true); err != nil {
+			t.Fatal(err)
+		}
+
+		opts := &jdb.Opts{Backend: prod, Checksum: sum}
+		rdb, err := jdb.OpenAt(fp+".prod", opts, &jdb.ReplayOpts{Index: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := rdb.Get("i").String(); v != "3" {
+			t.Errorf("expected 3, got %q", v)
+		}
+
+		// and back in place, without the history
+		if err = jdb.Convert(fp+".prod", prod, fp+".prod", jdb.JSONBackend, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = jdb.OpenAt(fp+".prod", &jdb.Opts{Checksum: sum}, &jdb.ReplayOpts{Index: 3}); err != jdb.ErrHistoryCompacted {
+			t.Errorf("expected ErrHistoryCompacted, got %v", err)
+		}
+
+		db, err = jdb.New(fp+".prod", &jdb.Opts{Checksum: sum})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := db.Get("i").String(); v != "5" {
+			t.Errorf("expected 5, got %q", v)
+		}
+		db.Close()
+	}
+}
+
+func TestObjects(t *testing.T) {
+	type obj struct {
+		Name  string
+		Data  []byte
+		Flags map[string]bool
+	}
+
+	for _, c := range backends {
+		fp := tmpPath("objects-" + c.name + ".jdb")
+		db := getJDB(t, fp, c.be)
+		in := obj{"jdb", []byte{0, 1, 2, 0xff}, map[string]bool{"isCool": true}}
+		if err := db.SetObject("obj", &in, "objects"); err != nil {
+			t.Fatal(c.name, err)
+		}
+		db.Close()
+
+		db = getJDB(t, fp, c.be)
+		var out obj
+		if err := db.GetObject("obj", &out, "objects"); err != nil {
+			t.Fatal(c.name, err)
+		}
+		if out.Name != in.Name || string(out.Data) != string(in.Data) || !out.Flags["isCool"] {
+			t.Errorf("%s: expected %+v, got %+v", c.name, in, out)
+		}
+		db.Close()
+	}
+}
+
+func TestGobBackend(t *testing.T) {
+	type obj struct {
+		T     time.Time
+		N     *big.Int
+		Flags map[int]uint8
+	}
+
+	fp := tmpPath("gob.jdb")
+	in := obj{time.Date(2016, 5, 4, 3, 2, 1, 123, time.FixedZone("X", 3600)), big.NewInt(1 << 62), map[int]uint8{-1: 255}}
+	in.N.Mul(in.N, in.N)
+
+	// every reopen starts a new gob stream in the same file
+	for i := 0; i < 3; i++ {
+		db := getJDB(t, fp, jdb.GobBackend)
+		if err := db.Update(func(tx *jdb.Tx) error {
+			if err := tx.SetObject("obj"+strconv.Itoa(i), &in); err != nil {
+				return err
+			}
+			tx.Set("del", jdb.Value("x"))
+			return tx.Bucket("b").Set("k", jdb.Value("v"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		db.Update(func(tx *jdb.Tx) error {
+			tx.Delete("del")
+			return tx.DeleteBucket("b")
+		})
+		db.Close()
+	}
+
+	db := getJDB(t, fp, jdb.GobBackend)
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		var out obj
+		if err := db.GetObject("obj"+strconv.Itoa(i), &out); err != nil {
+			t.Fatal(err)
+		}
+		if _, off := out.T.Zone(); !out.T.Equal(in.T) || off != 3600 || out.N.Cmp(in.N) != 0 || out.Flags[-1] != 255 {
+			t.Errorf("expected %+v, got %+v", in, out)
+		}
+	}
+	if db.Get("del") != nil || db.Get("k", "b") != nil {
+		t.Error("deletions weren't replayed")
+	}
+}
+
+func TestCBORSnapshot(t *testing.T) {
+	snapshot := func(name string, keys ...string) [sha256.Size]byte {
+		fp := tmpPath(name)
+		db := getJDB(t, fp, cbor.Backend)
+		for _, k := range keys {
+			db.Update(func(tx *jdb.Tx) error {
+				tx.Set(k, jdb.Value(k))
+				return tx.Bucket("b-"+k).Set(k, jdb.Value(k))
+			})
+		}
+		db.Update(func(tx *jdb.Tx) error { return tx.DeleteBucket("b-" + keys[0]) })
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		// the snapshot of the compacted file, not the file itself, the file holds timestamps
+		db = getJDB(t, fp, cbor.Backend)
+		defer db.Close()
+		var buf bytes.Buffer
+		if err := db.Snapshot(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return sha256.Sum256(buf.Bytes())
+	}
+
+	a := snapshot("cbor-a.jdb", "x", "a", "z", "m", "q")
+	b := snapshot("cbor-b.jdb", "x", "q", "m", "z", "a")
+	if a != b {
+		t.Errorf("expected identical snapshots:\n%x\n%x", a, b)
+	}
+	if c := snapshot("cbor-c.jdb", "x", "q", "m", "z"); a == c {
+		t.Error("expected different snapshots")
+	}
+}
+
+func TestCBORLimits(t *testing.T) {
+	const keys, depth = 140000, 40
+
+	fp := tmpPath("cbor-limits.jdb")
+	db := getJDB(t, fp, cbor.Backend)
+	err := db.Update(func(tx *jdb.Tx) error {
+		for i := 0; i < keys; i++ {
+			tx.Set(strconv.Itoa(i), jdb.Value("v"))
+		}
+		b := &tx.BucketTx
+		for i := 0; i < depth; i++ {
+			b = b.Bucket("b")
+		}
+		return b.Set("deep", jdb.Value("v"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for _, compact := range []bool{true, false} { // the second pass reads the compacted file
+		db = getJDB(t, fp, cbor.Backend)
+		db.Read(func(tx *jdb.Tx) error {
+			if n := len(tx.GetAll()); n != keys {
+				t.Errorf("expected %d keys, got %d", keys, n)
+			}
+			b := &tx.BucketTx
+			for i := 0; i < depth; i++ {
+				b = b.Bucket("b")
+			}
+			if v := b.Get("deep").String(); v != "v" {
+				t.Errorf("expected v, got %q", v)
+			}
+			return nil
+		})
+		if compact {
+			if err = db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestCompressDict(t *testing.T) {
+	fill := func(tx *jdb.Tx, i int) error {
+		u := tx.Bucket("users").Bucket("user-" + strconv.Itoa(i))
+		u.Set("name", jdb.Value("name "+strconv.Itoa(i)))
+		u.Set("email", jdb.Value("user"+strconv.Itoa(i)+"@example.com"))
+		return u.Set("bio", bytes.Repeat([]byte("lorem ipsum dolor sit amet "), i%50))
+	}
+
+	fp := tmpPath("dict-sample.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+	for i := 0; i < 100; i++ {
+		db.Update(func(tx *jdb.Tx) error { return fill(tx, i) })
+	}
+	db.Close()
+	sample, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, err := compress.BuildDict(16*1024, bytes.Split(sample, []byte("\n"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes [2]int64
+	for i, d := range [][]byte{nil, dict} {
+		d := d
+		be := func() jdb.Backend { return compress.ZstdBackend(jdb.JSONBackend(), d) }
+		fp := tmpPath("zstd-dict-" + strconv.Itoa(i) + ".jdb")
+		db := getJDB(t, fp, be)
+		for j := 100; j < 200; j++ {
+			if err := db.Update(func(tx *jdb.Tx) error { return fill(tx, j) }); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		db = getJDB(t, fp, be)
+		if v := db.Get("email", "users", "user-150").String(); v != "user150@example.com" {
+			t.Errorf("unexpected value %q", v)
+		}
+		db.Close()
+		st, err := os.Stat(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = st.Size()
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("expected the dictionary to help: %d >= %d", sizes[1], sizes[0])
+	}
+
+	// the zstd frames record the dictionary id
+	be := func() jdb.Backend { return compress.ZstdBackend(jdb.JSONBackend(), nil) }
+	if _, err := jdb.New(filepath.Join(tmpDir, "zstd-dict-1.jdb"), &jdb.Opts{Backend: be}); err == nil {
+		t.Error("expected an error opening the file without the dictionary")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	fp := tmpPath("header.jdb")
+	be := crypto.AESBackend(jdb.GZipJSONBackend, key[:])
+	db, err := jdb.New(fp, &jdb.Opts{Backend: be, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("a", jdb.Value("a"))
+	db.Close()
+
+	h, err := jdb.Probe(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 1 || h.Backend != "aes-cfb>gzip>json" || !h.Checksum || time.Since(h.Created) > time.Minute {
+		t.Fatalf("unexpected header: %+v", h)
+	}
+
+	if _, err = jdb.New(fp, &jdb.Opts{Backend: jdb.JSONBackend}); !errors.Is(err, jdb.ErrBackendMismatch) {
+		t.Fatalf("expected ErrBackendMismatch, got %v", err)
+	}
+	if _, err = jdb.OpenAt(fp, &jdb.Opts{Backend: jdb.GZipJSONBackend}, nil); !errors.Is(err, jdb.ErrBackendMismatch) {
+		t.Fatalf("expected ErrBackendMismatch, got %v", err)
+	}
+
+	// the checksum setting comes from the header
+	db = getJDB(t, fp, be)
+	if db.Get("a").String() != "a" {
+		t.Fatal("expected a")
+	}
+	if err = db.Rekey(jdb.GZipJSONBackend); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if h2, err := jdb.Probe(fp); err != nil || h2.Backend != "gzip>json" || !h2.Created.Equal(h.Created) || !h2.Checksum {
+		t.Fatalf("unexpected header: %+v %v", h2, err)
+	}
+
+	// files written without a header are still loaded, Compact adds one
+	fp = tmpPath("legacy.jdb")
+	if err = ioutil.WriteFile(fp, []byte(`{"idx":1,"ts":1,"cs":{"d":{"a":"YQ=="}}}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = jdb.Probe(fp); err != jdb.ErrNoHeader {
+		t.Fatalf("expected ErrNoHeader, got %v", err)
+	}
+	db = getJDB(t, fp, jdb.JSONBackend)
+	db.Set("b", jdb.Value("b"))
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if h, err = jdb.Probe(fp); err != nil || h.Backend != "json" || h.Checksum {
+		t.Fatalf("unexpected header: %+v %v", h, err)
+	}
+	db = getJDB(t, fp, jdb.JSONBackend)
+	if a, b := db.Get("a").String(), db.Get("b").String(); a != "a" || b != "b" {
+		t.Errorf("expected a and b, got %q and %q", a, b)
+	}
+	db.Close()
+}
+
+func TestLock(t *testing.T) {
+	fp := tmpPath("lock.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+	db.Set("a", jdb.Value("a"))
+
+	for _, ro := range []bool{false, true} {
+		if _, err := jdb.New(fp, &jdb.Opts{ReadOnly: ro}); err != jdb.ErrLocked {
+			t.Fatalf("read-only %v: expected ErrLocked, got %v", ro, err)
+		}
+	}
+
+	// the lock moves to the new file
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jdb.New(fp, nil); err != jdb.ErrLocked {
+		t.Fatalf("expected ErrLocked after Compact, got %v", err)
+	}
+
+	go func(db *jdb.DB) {
+		time.Sleep(50 * time.Millisecond)
+		db.Close()
+	}(db)
+	db, err := jdb.New(fp, &jdb.Opts{LockTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	ro1, err := jdb.New(fp, &jdb.Opts{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro1.Close()
+	ro2, err := jdb.New(fp, &jdb.Opts{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro2.Close()
+
+	if ro2.Get("a").String() != "a" {
+		t.Error("expected a")
+	}
+	if err = ro2.Set("b", jdb.Value("b")); err != jdb.ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err = jdb.New(fp, &jdb.Opts{LockTimeout: 20 * time.Millisecond}); err != jdb.ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fp := tmpPath("readonly.jdb")
+	if _, err := jdb.OpenReadOnly(fp, nil); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+	if _, err := os.Stat(fp); !os.IsNotExist(err) {
+		t.Fatal("OpenReadOnly created the file")
+	}
+
+	be := crypto.AESBackend(jdb.GZipJSONBackend, key[:])
+	db := getJDB(t, fp, be)
+	db.Set("a", jdb.Value("a"))
+	db.Close()
+	orig, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = jdb.OpenReadOnly(fp, &jdb.Opts{Backend: be, Recovery: jdb.RecoveryTruncateTorn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Get("a").String() != "a" {
+		t.Error("expected a")
+	}
+	for name, fn := range map[string]func() error{
+		"Update":  func() error { return db.Update(func(*jdb.Tx) error { return nil }) },
+		"Set":     func() error { return db.Set("b", jdb.Value("b")) },
+		"Compact": db.Compact,
+		"Rekey":   func() error { return db.Rekey(jdb.JSONBackend) },
+	} {
+		if err := fn(); err != jdb.ErrReadOnly {
+			t.Errorf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+	}
+	db.Close()
+
+	if b, _ := ioutil.ReadFile(fp); !bytes.Equal(b, orig) {
+		t.Error("the file was modified")
+	}
+
+	// backends that write a header of their own leave empty files alone too
+	fp = tmpPath("readonly-empty.jdb")
+	if err = ioutil.WriteFile(fp, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = jdb.OpenReadOnly(fp, &jdb.Opts{Backend: be}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if st, _ := os.Stat(fp); st.Size() != 0 {
+		t.Errorf("expected an empty file, got %d bytes", st.Size())
+	}
+}
+
+func TestFollow(t *testing.T) {
+	for _, c := range backends {
+		for _, sum := range []bool{false, true} {
+			testFollow(t, c.name+"-"+strconv.FormatBool(sum), jdb.Opts{Backend: c.be, Checksum: sum, FollowInterval: time.Millisecond})
+		}
+	}
+}
+
+func testFollow(t *testing.T, name string, opts jdb.Opts) {
+	fp := tmpPath("follow-" + name + ".jdb")
+	w, err := jdb.New(fp, &opts)
+	if err != nil {
+		t.Fatal(name, err)
+	}
+	defer w.Close()
+	w.Set("a", jdb.Value("a"))
+
+	r, err := jdb.Follow(fp, &opts)
+	if err != nil {
+		t.Fatal(name, err)
+	}
+	defer r.Close()
+
+	if v := r.Get("a").String(); v != "a" {
+		t.Fatalf("%s: expected a, got %q", name, v)
+	}
+	if err = r.Set("x", jdb.Value("x")); err != jdb.ErrReadOnly {
+		t.Fatalf("%s: expected ErrReadOnly, got %v", name, err)
+	}
+
+	eventually := func(key, exp string, bucket ...string) {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			if r.Get(key, bucket...).String() == exp {
+				return
+			}
+		}
+		t.Fatalf("%s: expected %s to be %q, got %q (%v)", name, key, exp, r.Get(key, bucket...), r.FollowErr())
+	}
+
+	w.Set("b", jdb.Value("b"), "bucket")
+	eventually("b", "b", "bucket")
+
+	if err = w.Compact(); err != nil {
+		t.Fatal(name, err)
+	}
+	w.Set("c", jdb.Value("c"))
+	eventually("c", "c")
+	w.Update(func(tx *jdb.Tx) error {
+		tx.Delete("a")
+		return tx.Set("d", jdb.Value("d"))
+	})
+	eventually("d", "d")
+	eventually("a", "")
+	eventually("b", "b", "bucket")
+
+	if err = r.FollowErr(); err != nil {
+		t.Errorf("%s: unexpected error: %v", name, err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	fp := tmpPath("replay.jdb")
+	db := getJDB(t, fp, jdb.GZipJSONBackend)
+	for i := 1; i <= 5; i++ {
+		if err := db.Set("i", jdb.Value(strconv.Itoa(i)), "cfg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 1; i <= 5; i++ {
+		rdb, err := db.Replay(&jdb.ReplayOpts{Index: uint64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := rdb.Get("i", "cfg").String(); v != strconv.Itoa(i) {
+			t.Errorf("expected %d, got %s", i, v)
+		}
+		if err := rdb.Set("i", jdb.Value("x"), "cfg"); err != jdb.ErrReadOnly {
+			t.Errorf("expected ErrReadOnly, got %v", err)
+		}
+		rdb.Close()
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := jdb.OpenAt(fp, &jdb.Opts{Backend: jdb.GZipJSONBackend}, &jdb.ReplayOpts{Index: 3}); err != jdb.ErrHistoryCompacted {
+		t.Fatal("expected ErrHistoryCompacted, got", err)
+	}
+
+	rdb, err := jdb.OpenAt(fp, &jdb.Opts{Backend: jdb.GZipJSONBackend}, &jdb.ReplayOpts{Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := rdb.Get("i", "cfg").String(); v != "5" {
+		t.Errorf("expected 5, got %s", v)
+	}
+}
+
+// TestReplayPartial makes sure Replay doesn't read a transaction that is still being written.
+func TestReplayPartial(t *testing.T) {
+	fp := tmpPath("replay-partial.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+	defer db.Close()
+	db.Set("a", jdb.Value("a"))
+
+	// the first half of a transaction another goroutine is writing
+	f, err := os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"idx":2,"ts":`)
+	f.Close()
+
+	rdb, err := db.Replay(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := rdb.Get("a").String(); v != "a" {
+		t.Errorf("expected a, got %q", v)
+	}
+	rdb.Close()
+}
+
+func TestReplayFilter(t *testing.T) {
+	fp := tmpPath("replay-filter.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+	db.Set("a", jdb.Value("1"))
+	db.Set("a", jdb.Value("bad"))
+	db.Update(func(tx *jdb.Tx) error {
+		tx.Bucket("poison").Set("x", jdb.Value("x"))
+		tx.Bucket("users").Set("password", jdb.Value("hunter2"))
+		return tx.Set("b", jdb.Value("2"))
+	})
+	db.Close()
+
+	opts := &jdb.Opts{
+		ReplayFilter: func(ti jdb.TxInfo, cs *jdb.ChangeSet) (bool, error) {
+			if v, _ := cs.Get("a"); v.String() == "bad" {
+				return false, nil
+			}
+			cs.RemoveBucket("poison")
+			if u := cs.Bucket("users"); u != nil {
+				u.Set("password", jdb.Value("*"))
+			}
+			return true, nil
+		},
+	}
+
+	db, err := jdb.New(fp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if v := db.Get("a").String(); v != "1" {
+		t.Errorf("expected 1, got %s", v)
+	}
+	if v := db.Get("b").String(); v != "2" {
+		t.Errorf("expected 2, got %s", v)
+	}
+	if v := db.Get("x", "poison"); v != nil {
+		t.Errorf("expected nil, got %s", v)
+	}
+	if v := db.Get("password", "users").String(); v != "*" {
+		t.Errorf("expected *, got %s", v)
+	}
+
+	// make sure the skipped transaction didn't reuse an index
+	db.Set("c", jdb.Value("3"))
+	rdb, err := db.Replay(&jdb.ReplayOpts{Index: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := rdb.Get("c"); v != nil {
+		t.Errorf("expected nil, got %s", v)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	fp := tmpPath("sequence.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+
+	next := func(exp uint64) {
+		if err := db.Update(func(tx *jdb.Tx) error {
+			id, err := tx.Bucket("users").NextSequence()
+			if err != nil {
+				return err
+			}
+			if id != exp {
+				t.Errorf("expected %d, got %d", exp, id)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next(1)
+	next(2)
+	db.Update(func(tx *jdb.Tx) error {
+		tx.Bucket("users").NextSequence()
+		return errors.New("rollback")
+	})
+	next(3)
+	db.Close()
+
+	db = getJDB(t, fp, jdb.JSONBackend)
+	next(4)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = getJDB(t, fp, jdb.JSONBackend)
+	defer db.Close()
+	next(5)
+
+	db.Read(func(tx *jdb.Tx) error {
+		if seq := tx.Bucket("users").Sequence(); seq != 5 {
+			t.Errorf("expected 5, got %d", seq)
+		}
+		if _, err := tx.NextSequence(); err != jdb.ErrReadOnly {
+			t.Errorf("expected ErrReadOnly, got %v", err)
+		}
+		return nil
+	})
+}
+
+func TestSnapshots(t *testing.T) {
+	fp := tmpPath("snapshots.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+	defer db.Close()
+
+	if err := db.Set("a", jdb.Value("1"), "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader doesn't block writers and keeps seeing the version it started with
+	if err := db.Read(func(tx *jdb.Tx) error {
+		done := make(chan error, 1)
+		go func() {
+			done <- db.Update(func(tx *jdb.Tx) error {
+				tx.Bucket("b").Set("a", jdb.Value("2"))
+				return tx.Bucket("c").Set("a", jdb.Value("3"))
+			})
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Update blocked on Read")
+		}
+
+		if v := tx.Bucket("b").Get("a"); string(v) != "1" {
+			t.Errorf("expected 1, got %q", v)
+		}
+		if v := tx.Bucket("c").Get("a"); v != nil {
+			t.Errorf("expected nil, got %q", v)
+		}
+		if v := db.Get("a", "b"); string(v) != "2" {
+			t.Errorf("expected 2, got %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// and writers don't block readers
+	if err := db.Update(func(tx *jdb.Tx) error {
+		tx.Bucket("b").Set("a", jdb.Value("4"))
+		if v := db.Get("a", "b"); string(v) != "2" {
+			t.Errorf("expected 2, got %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v := db.Get("a", "b"); string(v) != "4" {
+		t.Errorf("expected 4, got %q", v)
+	}
+}
+
+func TestSnapshotsRandom(t *testing.T) {
+	fp := tmpPath("snapshots-random.jdb")
+	db := getJDB(t, fp, msgpack.Backend)
+
+	var (
+		r     = rand.New(rand.NewSource(42))
+		exp   = map[string]map[string]string{}
+		names = []string{"a", "b", "c"}
+	)
+
+	check := func(tx *jdb.Tx, exp map[string]map[string]string) {
+		for _, bn := range names {
+			b := tx.Bucket(bn)
+			if all := b.GetAll(); len(all) != len(exp[bn]) {
+				t.Fatalf("%s: expected %d keys, got %d", bn, len(exp[bn]), len(all))
+			}
+			for k, v := range exp[bn] {
+				if got := b.Get(k); string(got) != v {
+					t.Fatalf("%s/%s: expected %q, got %q", bn, k, v, got)
+				}
+			}
+		}
+	}
+
+	copyExp := func() map[string]map[string]string {
+		cp := map[string]map[string]string{}
+		for bn, m := range exp {
+			cp[bn] = map[string]string{}
+			for k, v := range m {
+				cp[bn][k] = v
+			}
+		}
+		return cp
+	}
+
+	for i := 0; i < 200; i++ {
+		before := copyExp()
+		var snap *jdb.Tx
+		release := make(chan struct{})
+		opened := make(chan struct{})
+		go db.Read(func(tx *jdb.Tx) error {
+			snap = tx
+			close(opened)
+			<-release
+			return nil
+		})
+		<-opened
+
+		if err := db.Update(func(tx *jdb.Tx) error {
+			for j := 0; j < 50; j++ {
+				bn, k := names[r.Intn(len(names))], strconv.Itoa(r.Intn(2000))
+				if exp[bn] == nil {
+					exp[bn] = map[string]string{}
+				}
+				if r.Intn(3) == 0 {
+					delete(exp[bn], k)
+					tx.Bucket(bn).Delete(k)
+				} else {
+					v := strconv.Itoa(r.Int())
+					exp[bn][k] = v
+					tx.Bucket(bn).Set(k, jdb.Value(v))
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		check(snap, before)
+		close(release)
+	}
+
+	db.Read(func(tx *jdb.Tx) error { check(tx, exp); return nil })
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = getJDB(t, fp, msgpack.Backend)
+	defer db.Close()
+	db.Read(func(tx *jdb.Tx) error { check(tx, exp); return nil })
+}
+
+func TestBatch(t *testing.T) {
+	fp := tmpPath("batch.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 100)
+		fail = errors.New("fail")
+	)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Batch(func(tx *jdb.Tx) error {
+				tx.Set(strconv.Itoa(i), jdb.Value("x"))
+				if i%5 == 0 {
+					return fail
+				}
+				return tx.Bucket("b").Set(strconv.Itoa(i), jdb.Value("y"))
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("expected the panic to be re-raised, got %v", p)
+			}
+		}()
+		db.Batch(func(tx *jdb.Tx) error {
+			tx.Set("panic", jdb.Value("x"))
+			panic("boom")
+		})
+	}()
+
+	check := func(db *jdb.DB) {
+		for i, err := range errs {
+			k := strconv.Itoa(i)
+			if i%5 == 0 {
+				if err != fail {
+					t.Errorf("%d: expected fail, got %v", i, err)
+				}
+				if db.Get(k) != nil {
+					t.Errorf("%d: the failed call wasn't rolled back", i)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%d: %v", i, err)
+			}
+			if string(db.Get(k)) != "x" || string(db.Get(k, "b")) != "y" {
+				t.Errorf("%d: missing values", i)
+			}
+		}
+		if db.Get("panic") != nil {
+			t.Error("the panicking call wasn't rolled back")
+		}
+	}
+
+	check(db)
+	db.Close()
+
+	db = getJDB(t, fp, jdb.JSONBackend)
+	defer db.Close()
+	check(db)
+
+	if err := db.Batch(func(tx *jdb.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := db.Batch(func(tx *jdb.Tx) error { return nil }); err != jdb.ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+// TestFailedSync checks that the backends can keep writing after a transaction was truncated away,
+// GCMBackend numbers its records and AESBackend continues a single stream.
+func TestFailedSync(t *testing.T) {
+	errSync := errors.New("sync failed")
+	for _, c := range backends {
+		for _, sum := range []bool{false, true} {
+			name := c.name + "-" + strconv.FormatBool(sum)
+			fp := tmpPath("failed-sync-" + name + ".jdb")
+			opts := &jdb.Opts{Backend: c.be, Checksum: sum}
+			db, err := jdb.New(fp, opts)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			db.Set("1", jdb.Value("v"))
+
+			restore := jdb.SetFsync(func(*os.File) error { return errSync })
+			if err = db.Set("2", jdb.Value("v")); err != errSync {
+				t.Fatalf("%s: expected %v, got %v", name, errSync, err)
+			}
+			if err = db.Batch(func(tx *jdb.Tx) error { return tx.Set("3", jdb.Value("v")) }); err != errSync {
+				t.Fatalf("%s: expected %v, got %v", name, errSync, err)
+			}
+			restore()
+
+			if err = db.Set("4", jdb.Value("v")); err != nil {
+				t.Fatal(name, err)
+			}
+			db.Close()
+
+			if db, err = jdb.New(fp, opts); err != nil {
+				t.Fatal(name, err)
+			}
+			for k, exp := range map[string]string{"1": "v", "2": "", "3": "", "4": "v"} {
+				if v := db.Get(k).String(); v != exp {
+					t.Errorf("%s: %s: expected %q, got %q", name, k, exp, v)
+				}
+			}
+			db.Close()
+		}
+	}
+}
+
+func TestSyncModes(t *testing.T) {
+	// durable is the size of each file the last time it was synced, a crash loses everything after it
+	var (
+		mux     sync.Mutex
+		durable = map[string]int64{}
+	)
+	defer jdb.SetFsync(func(f *os.File) error {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		mux.Lock()
+		durable[f.Name()] = st.Size()
+		mux.Unlock()
+		return nil
+	})()
+
+	// crash returns how many of the n committed transactions survive a crash of the machine
+	crash := func(name, fp string, n int) int {
+		mux.Lock()
+		size := durable[fp]
+		mux.Unlock()
+
+		data, err := ioutil.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfp := tmpPath(name + "-crashed.jdb")
+		if err = ioutil.WriteFile(cfp, data[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := jdb.New(cfp, &jdb.Opts{Recovery: jdb.RecoveryTruncateTorn})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		defer db.Close()
+
+		var kept int
+		for i := 0; i < n; i++ {
+			if db.Get(strconv.Itoa(i)) != nil {
+				kept++
+			} else if db.Get(strconv.Itoa(i+1)) != nil {
+				t.Fatalf("%s: %d was lost but not %d", name, i, i+1)
+			}
+		}
+		return kept
+	}
+
+	const n = 100
+	const interval = 20 * time.Millisecond
+	for _, c := range []struct {
+		name string
+		mode jdb.SyncMode
+	}{
+		{"always", jdb.SyncAlways},
+		{"every", jdb.SyncEvery(interval)},
+		{"never", jdb.SyncNever},
+	} {
+		fp := tmpPath("sync-" + c.name + ".jdb")
+		db, err := jdb.New(fp, &jdb.Opts{SyncMode: c.mode})
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+
+		for i := 0; i < n; i++ {
+			if err := db.Set(strconv.Itoa(i), jdb.Value("x")); err != nil {
+				t.Fatal(c.name, err)
+			}
+		}
+
+		kept := crash(c.name, fp, n)
+		t.Logf("%s: a crash right after the last commit loses %d of %d transactions", c.name, n-kept, n)
+
+		switch c.mode {
+		case jdb.SyncAlways:
+			if kept != n {
+				t.Errorf("%s: lost %d transactions", c.name, n-kept)
+			}
+		case jdb.SyncNever:
+			if kept != 0 {
+				t.Errorf("%s: expected everything to be lost, kept %d", c.name, kept)
+			}
+		}
+
+		if c.mode == jdb.SyncNever {
+			if err = db.Sync(); err != nil {
+				t.Fatal(c.name, err)
+			}
+		} else {
+			time.Sleep(5 * interval)
+		}
+		if kept = crash(c.name, fp, n); kept != n {
+			t.Errorf("%s: lost %d transactions after syncing", c.name, n-kept)
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(c.name, err)
+		}
+		if err = db.Sync(); err != jdb.ErrClosed {
+			t.Fatalf("%s: expected ErrClosed, got %v", c.name, err)
+		}
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	// waitFor polls db.Stats until fn returns true
+	waitFor := func(name string, db *jdb.DB, fn func(st jdb.Stats) bool) jdb.Stats {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			st := db.Stats()
+			if fn(st) {
+				return st
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: timed out: %+v", name, st)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		ac   jdb.AutoCompact
+	}{
+		{"txs", jdb.AutoCompact{Txs: 10}},
+		{"ratio", jdb.AutoCompact{Ratio: 4}},
+		{"interval", jdb.AutoCompact{Interval: 10 * time.Millisecond}},
+	} {
+		fp := tmpPath("auto-compact-" + c.name + ".jdb")
+		opts := &jdb.Opts{AutoCompact: c.ac}
+		db, err := jdb.New(fp, opts)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			if err := db.Set("key", jdb.Value(strconv.Itoa(i)), "b"); err != nil {
+				t.Fatal(c.name, err)
+			}
+		}
+
+		waitFor(c.name, db, func(st jdb.Stats) bool { return st.AutoCompactions > 0 })
+		// let a pending check finish, nothing was written since, so nothing triggers another compaction
+		time.Sleep(50 * time.Millisecond)
+		st := db.Stats()
+		time.Sleep(50 * time.Millisecond)
+		if st2 := db.Stats(); st2.Compactions != st.Compactions {
+			t.Fatalf("%s: unexpected compaction: %+v", c.name, st2)
+		}
+
+		if lc := st.LastCompact; !lc.Auto || lc.Err != nil || lc.After >= lc.Before {
+			t.Fatalf("%s: unexpected stats: %+v", c.name, st)
+		}
+		if st.Commits != 100 || st.Compactions != st.AutoCompactions || st.LiveSize != int64(len("b")+len("key")+len("99")) {
+			t.Fatalf("%s: unexpected stats: %+v", c.name, st)
+		}
+		if c.ac.Ratio > 0 && float64(st.FileSize) > c.ac.Ratio*float64(st.LastCompact.After) {
+			t.Fatalf("%s: the file wasn't compacted: %+v", c.name, st)
+		}
+
+		if err = db.Compact(); err != nil {
+			t.Fatal(c.name, err)
+		}
+		if st2 := db.Stats(); st2.Compactions != st.Compactions+1 || st2.AutoCompactions != st.AutoCompactions || st2.LastCompact.Auto {
+			t.Fatalf("%s: unexpected stats: %+v", c.name, st2)
+		}
+		db.Close()
+
+		db = getJDB(t, fp, jdb.JSONBackend)
+		if v := db.Get("key", "b"); string(v) != "99" {
+			t.Fatalf("%s: expected 99, got %q", c.name, v)
+		}
+		db.Close()
+	}
+}
+
+func TestBegin(t *testing.T) {
+	fp := tmpPath("begin.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tx.Bucket("b")
+	if err = b.Set("a", jdb.Value("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only one writable transaction at a time
+	next := make(chan *jdb.Tx)
+	go func() {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Error(err)
+		}
+		next <- tx
+	}()
+	select {
+	case <-next:
+		t.Fatal("Begin(true) didn't wait for the open transaction")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx2 := <-next
+
+	if err = tx.Commit(); err != jdb.ErrTxClosed {
+		t.Fatalf("expected ErrTxClosed, got %v", err)
+	}
+	if err = tx.Rollback(); err != jdb.ErrTxClosed {
+		t.Fatalf("expected ErrTxClosed, got %v", err)
+	}
+	if err = b.Set("a", jdb.Value("2")); err != jdb.ErrTxClosed {
+		t.Fatalf("expected ErrTxClosed, got %v", err)
+	}
+	if v := tx.Bucket("b").Get("a"); v != nil {
+		t.Fatalf("a closed tx returned %q", v)
+	}
+
+	if v := rtx.Bucket("b").Get("a"); v != nil {
+		t.Fatalf("the read tx saw a later commit: %q", v)
+	}
+	if err = rtx.Set("a", jdb.Value("1")); err != jdb.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err = rtx.Commit(); err != jdb.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err = rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err = rtx.Rollback(); err != jdb.ErrTxClosed {
+		t.Fatalf("expected ErrTxClosed, got %v", err)
+	}
+
+	tx2.Bucket("b").Set("a", jdb.Value("2"))
+	if err = tx2.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if v := db.Get("a", "b"); string(v) != "1" {
+		t.Fatalf("expected 1, got %q", v)
+	}
+
+	if err = db.Update(func(tx *jdb.Tx) error {
+		if err := tx.Commit(); err != jdb.ErrTxManaged {
+			t.Errorf("expected ErrTxManaged, got %v", err)
+		}
+		return tx.Set("c", jdb.Value("3"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+	if _, err = db.Begin(true); err != jdb.ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	db = getJDB(t, fp, jdb.JSONBackend)
+	defer db.Close()
+	if v := db.Get("a", "b"); string(v) != "1" {
+		t.Fatalf("expected 1, got %q", v)
+	}
+	if v := db.Get("c"); string(v) != "3" {
+		t.Fatalf("expected 3, got %q", v)
+	}
+}
+
+func TestContext(t *testing.T) {
+	fp := tmpPath("context.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+	defer db.Close()
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "v")
+
+	if err := db.UpdateContext(ctx, func(tx *jdb.Tx) error {
+		if tx.Context().Value(ctxKey{}) != "v" {
+			t.Error("unexpected context")
+		}
+		return tx.Set("a", jdb.Value("1"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// waiting for a stuck writer gives up
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err = db.UpdateContext(tctx, func(tx *jdb.Tx) error {
+		t.Error("fn shouldn't be called")
+		return nil
+	}); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a transaction whose context is done isn't committed
+	cctx, cancel := context.WithCancel(ctx)
+	rollbacks := db.Stats().Rollbacks
+	if err = db.UpdateContext(cctx, func(tx *jdb.Tx) error {
+		tx.Set("a", jdb.Value("2"))
+		cancel()
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if v := db.Get("a"); string(v) != "1" {
+		t.Fatalf("expected 1, got %q", v)
+	}
+	if st := db.Stats(); st.Rollbacks != rollbacks+1 {
+		t.Fatalf("expected %d rollbacks, got %d", rollbacks+1, st.Rollbacks)
+	}
+
+	if err = db.ReadContext(cctx, func(tx *jdb.Tx) error {
+		t.Error("fn shouldn't be called")
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if err = db.ReadContext(ctx, func(tx *jdb.Tx) error {
+		if tx.Context() != ctx {
+			t.Error("unexpected context")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Read(func(tx *jdb.Tx) error {
+		if tx.Context() != context.Background() {
+			t.Error("expected context.Background()")
+		}
+		return nil
+	})
+}
+
+func TestSavepoint(t *testing.T) {
+	fp := tmpPath("savepoint.jdb")
+	db := getJDB(t, fp, jdb.JSONBackend)
+	defer db.Close()
+
+	if err := db.Set("old", jdb.Value("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	var leaked *jdb.Savepoint
+	expect := func(b *jdb.BucketTx, key, exp string) {
+		if v := b.Get(key); string(v) != exp {
+			t.Fatalf("%s: expected %q, got %q", key, exp, v)
+		}
+	}
+
+	if err := db.Update(func(tx *jdb.Tx) error {
+		b := tx.Bucket("b")
+		tx.Set("a", jdb.Value("1"))
+		b.Set("x", jdb.Value("1"))
+
+		sp1, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+		tx.Set("a", jdb.Value("2"))
+		tx.Delete("old")
+		b.Set("x", jdb.Value("2"))
+		b.Set("y", jdb.Value("2"))
+		b.NextSequence()
+		tx.Bucket("c").Set("z", jdb.Value("2"))
+
+		sp2, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+		tx.Set("a", jdb.Value("3"))
+
+		if err = sp1.RollbackTo(); err != nil {
+			return err
+		}
+		expect(&tx.BucketTx, "a", "1")
+		expect(&tx.BucketTx, "old", "1")
+		expect(b, "x", "1")
+		expect(b, "y", "")
+		if seq := b.Sequence(); seq != 0 {
+			t.Errorf("expected 0, got %d", seq)
+		}
+		if bs := tx.Buckets(); len(bs) != 1 || bs[0] != "b" {
+			t.Errorf("unexpected buckets: %v", bs)
+		}
+		if err = sp2.RollbackTo(); err != jdb.ErrSavepointReleased {
+			t.Errorf("expected ErrSavepointReleased, got %v", err)
+		}
+
+		// a savepoint can be rolled back to more than once
+		b.Set("x", jdb.Value("4"))
+		if err = sp1.RollbackTo(); err != nil {
+			return err
+		}
+		expect(b, "x", "1")
+		if err = sp1.Release(); err != nil {
+			return err
+		}
+		if err = sp1.RollbackTo(); err != jdb.ErrSavepointReleased {
+			t.Errorf("expected ErrSavepointReleased, got %v", err)
+		}
+
+		fail := errors.New("fail")
+		if err = tx.Nested(func(tx *jdb.Tx) error {
+			tx.Bucket("b").Set("x", jdb.Value("5"))
+			return tx.Nested(func(tx *jdb.Tx) error {
+				tx.Set("n", jdb.Value("5"))
+				return nil
+			})
+		}); err != nil {
+			return err
+		}
+		if err = tx.Nested(func(tx *jdb.Tx) error {
+			tx.Set("a", jdb.Value("6"))
+			tx.Bucket("d").Set("z", jdb.Value("6"))
+			return fail
+		}); err != fail {
+			t.Errorf("expected fail, got %v", err)
+		}
+
+		leaked, err = tx.Savepoint()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leaked.RollbackTo(); err != jdb.ErrSavepointReleased {
+		t.Fatalf("expected ErrSavepointReleased, got %v", err)
+	}
+
+	db.Read(func(tx *jdb.Tx) error {
+		expect(&tx.BucketTx, "a", "1")
+		expect(&tx.BucketTx, "old", "1")
+		expect(&tx.BucketTx, "n", "5")
+		expect(tx.Bucket("b"), "x", "5")
+		if bs := tx.Buckets(); len(bs) != 1 || bs[0] != "b" {
+			t.Errorf("unexpected buckets: %v", bs)
+		}
+		if _, err := tx.Savepoint(); err != jdb.ErrReadOnly {
+			t.Errorf("expected ErrReadOnly, got %v", err)
+		}
+		return nil
+	})
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := tx.Savepoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sp.RollbackTo(); err != jdb.ErrSavepointReleased {
+		t.Fatalf("expected ErrSavepointReleased, got %v", err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	fp := tmpPath("archive.jdb")
+	opts := &jdb.Opts{
+		Backend:          jdb.GZipJSONBackend,
+		ArchiveDir:       tmpPath("archives"),
+		CompressArchives: true,
+	}
+	db, err := jdb.New(fp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 1; i <= 3; i++ {
+		db.Set("a", jdb.Value(strconv.Itoa(i)))
+		db.Set("b", jdb.Value(strconv.Itoa(i)))
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	as, err := db.Archives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 3 {
+		t.Fatalf("expected 3 archives, got %d", len(as))
+	}
+
+	for i, a := range as {
+		if !a.Compressed {
+			t.Errorf("%s isn't compressed", a.Path)
+		}
+		if i > 0 && a.Time.Before(as[i-1].Time) {
+			t.Errorf("%s is out of order", a.Path)
+		}
+
+		adb, err := db.ReplayArchive(a, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := adb.Get("a").String(); v != strconv.Itoa(i+1) {
+			t.Errorf("%s: expected %d, got %s", a.Path, i+1, v)
+		}
+	}
+
+	// the last archive starts with the second snapshot
+	adb, err := db.ReplayArchive(as[2], nil, &jdb.ReplayOpts{Index: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := adb.Get("a").String(), adb.Get("b").String(); a != "3" || b != "2" {
+		t.Errorf("expected 3 and 2, got %s and %s", a, b)
+	}
+
+	// the segments archived before Rekey need the old backend
+	if err = db.Rekey(jdb.JSONBackend); err != nil {
+		t.Fatal(err)
+	}
+	if as, err = db.Archives(); err != nil || len(as) != 4 {
+		t.Fatalf("expected 4 archives, got %d: %v", len(as), err)
+	}
+	if _, err = db.ReplayArchive(as[3], nil, nil); !errors.Is(err, jdb.ErrBackendMismatch) {
+		t.Fatalf("expected ErrBackendMismatch, got %v", err)
+	}
+	if adb, err = db.ReplayArchive(as[3], jdb.GZipJSONBackend, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := adb.Get("a").String(); v != "3" {
+		t.Errorf("expected 3, got %s", v)
+	}
+}
+
+var backends = []struct {
+	name string
+	be   func() jdb.Backend
+}{
+	{"json", jdb.JSONBackend},
+	{"gzip-json", jdb.GZipJSONBackend},
+	{"crypto-json", crypto.AESBackend(jdb.JSONBackend, key[:])},
+	{"crypto-gzip-json", crypto.AESBackend(jdb.GZipJSONBackend, key[:])},
+	{"gcm-json", crypto.GCMBackend(jdb.JSONBackend, key[:])},
+	{"gcm-gzip-json", crypto.GCMBackend(jdb.GZipJSONBackend, key[:])},
+	{"msgpack", msgpack.Backend},
+	{"gzip-msgpack", func() jdb.Backend { return jdb.GZipBackend(msgpack.Backend()) }},
+	{"gob", jdb.GobBackend},
+	{"cbor", cbor.Backend},
+	{"zstd-json", func() jdb.Backend { return compress.ZstdBackend(jdb.JSONBackend(), nil) }},
+	{"lz4-json", func() jdb.Backend { return compress.LZ4Backend(jdb.JSONBackend()) }},
+	{"lz4-msgpack", func() jdb.Backend { return compress.LZ4Backend(msgpack.Backend()) }},
+	{"gzip-gob", func() jdb.Backend { return jdb.GZipBackend(jdb.GobBackend()) }},
+}
+
+// copyFile copies an open database file, simulating a crash.
+func copyFile(tb testing.TB, src, dst string) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dst, b, 0600); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestReopenAfterCrash(t *testing.T) {
+	for _, c := range backends {
+		fp := tmpPath("crash-" + c.name + ".jdb")
+		os.Remove(fp + ".crashed")
+		db := getJDB(t, fp, c.be)
+		db.Set("a", jdb.Value("a"))
+		copyFile(t, fp, fp+".crashed")
+		db.Close()
+
+		db = getJDB(t, fp+".crashed", c.be)
+		db.Set("b", jdb.Value("b"))
+		db.Close()
+
+		db = getJDB(t, fp+".crashed", c.be)
+		if a, b := db.Get("a").String(), db.Get("b").String(); a != "a" || b != "b" {
+			t.Errorf("%s: expected a and b, got %q and %q", c.name, a, b)
+		}
+		db.Close()
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	for _, c := range backends {
+		for _, sum := range []bool{false, true} {
+			testRecovery(t, c.name+"-"+strconv.FormatBool(sum), jdb.Opts{Backend: c.be, Checksum: sum})
+		}
+	}
+}
+
+func testRecovery(t *testing.T, name string, opts jdb.Opts) {
+	fp := tmpPath("torn-" + name + ".jdb")
+	db, err := jdb.New(fp, &opts)
+	if err != nil {
+		t.Fatal(name, err)
+	}
+	for i := 1; i <= 3; i++ {
+		db.Set(strconv.Itoa(i), jdb.Value("v"))
+	}
+	db.Close()
+
+	st, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(fp, st.Size()-12); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jdb.New(fp, &opts); err == nil {
+		t.Fatalf("%s: expected an error", name)
+	}
+
+	opts.Recovery = jdb.RecoveryIgnore
+	if db, err = jdb.New(fp, &opts); err != nil {
+		t.Fatal(name, err)
+	}
+	if rr := db.Recovery(); rr == nil || rr.LastIndex != 2 || rr.Repaired {
+		t.Fatalf("%s: unexpected report: %+v", name, rr)
+	}
+	if err := db.Set("x", jdb.Value("x")); err != jdb.ErrReadOnly {
+		t.Fatalf("%s: expected ErrReadOnly, got %v", name, err)
+	}
+	db.Close()
+
+	torn, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(fp + ".corrupt")
+
+	opts.Recovery = jdb.RecoveryTruncateTorn
+	if !opts.Checksum {
+		if _, err = jdb.New(fp, &opts); !errors.Is(err, jdb.ErrNoChecksums) {
+			t.Fatalf("%s: expected ErrNoChecksums, got %v", name, err)
+		}
+		return
+	}
+	if db, err = jdb.New(fp, &opts); err != nil {
+		t.Fatal(name, err)
+	}
+	if rr := db.Recovery(); rr == nil || rr.LastIndex != 2 || rr.Transactions != 2 || !rr.Repaired || rr.Backup != fp+".corrupt" {
+		t.Fatalf("%s: unexpected report: %+v", name, rr)
+	}
+	if b, _ := ioutil.ReadFile(fp + ".corrupt"); !bytes.Equal(b, torn) {
+		t.Fatalf("%s: the backup doesn't match the original file", name)
+	}
+	if err := db.Set("4", jdb.Value("v")); err != nil {
+		t.Fatal(name, err)
+	}
+	db.Close()
+
+	opts.Recovery = jdb.RecoveryFail
+	if db, err = jdb.New(fp, &opts); err != nil {
+		t.Fatal(name, err)
+	}
+	for k, exp := range map[string]string{"1": "v", "2": "v", "3": "", "4": "v"} {
+		if v := db.Get(k).String(); v != exp {
+			t.Errorf("%s: %s: expected %q, got %q", name, k, exp, v)
+		}
+	}
+	db.Close()
+}
+
+func TestRecoveryCorrupt(t *testing.T) {
+	// flipping a bit in the size of a length prefixed record makes the decoder read to the end of the file,
+	// which looks like a torn write without checksums
+	sizeBit := func(b []byte, off int) { b[off+2] ^= 1 }
+	for _, c := range []struct {
+		name    string
+		be      func() jdb.Backend
+		corrupt func(b []byte, off int)
+	}{
+		{"json", jdb.JSONBackend, func(b []byte, off int) { b[off] = 'x' }},
+		{"gcm-json", crypto.GCMBackend(jdb.JSONBackend, key[:]), sizeBit},
+		{"zstd-json", func() jdb.Backend { return compress.ZstdBackend(jdb.JSONBackend(), nil) }, sizeBit},
+		{"lz4-json", func() jdb.Backend { return compress.LZ4Backend(jdb.JSONBackend()) }, sizeBit},
+		{"gob", jdb.GobBackend, func(b []byte, off int) { b[off] ^= 0x40 }},
+	} {
+		for _, sum := range []bool{false, true} {
+			name := c.name + "-" + strconv.FormatBool(sum)
+			fp := tmpPath("corrupt-" + name + ".jdb")
+			os.Remove(fp + ".corrupt")
+			open := func() *jdb.DB {
+				db, err := jdb.New(fp, &jdb.Opts{Backend: c.be, Checksum: sum})
+				if err != nil {
+					t.Fatal(name, err)
+				}
+				return db
+			}
+			db := open()
+			db.Set("1", jdb.Value("v"))
+			db.Close()
+
+			st, err := os.Stat(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db = open()
+			for i := 2; i <= 10; i++ {
+				db.Set(strconv.Itoa(i), jdb.Value("v"))
+			}
+			db.Close()
+
+			b, err := ioutil.ReadFile(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// break the second transaction, the eight after it are intact
+			off := int(st.Size())
+			if sum {
+				sizeBit(b, off+4) // the size of the frame
+			} else {
+				c.corrupt(b, off)
+			}
+			if err = ioutil.WriteFile(fp, b, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = jdb.New(fp, &jdb.Opts{Backend: c.be, Checksum: sum, Recovery: jdb.RecoveryTruncateTorn})
+			if err == nil {
+				t.Fatalf("%s: expected an error", name)
+			}
+			if !sum && !errors.Is(err, jdb.ErrNoChecksums) {
+				t.Fatalf("%s: expected ErrNoChecksums, got %v", name, err)
+			}
+			if b2, _ := ioutil.ReadFile(fp); !bytes.Equal(b, b2) {
+				t.Fatalf("%s: the file was modified: %d -> %d bytes", name, len(b), len(b2))
+			}
+			if _, err = os.Stat(fp + ".corrupt"); !os.IsNotExist(err) {
+				t.Fatalf("%s: unexpected backup: %v", name, err)
+			}
+		}
+	}
+}
+
+// testdata/baseline-*.jdb were written by the version before every gzip'ed transaction got its own member,
+// baseline-gzip.jdb was never closed and AESBackend never closed the gzip stream of baseline-aes-gzip.jdb.
+func TestBaselineGZip(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		be   func() jdb.Backend
+	}{
+		{"gzip", jdb.GZipJSONBackend},
+		{"aes-gzip", crypto.AESBackend(jdb.GZipJSONBackend, key[:])},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", "baseline-"+c.name+".jdb"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp := tmpPath("baseline-" + c.name + ".jdb")
+		if err = ioutil.WriteFile(fp, b, 0600); err != nil {
+			t.Fatal(err)
+		}
 
-	//defer os.RemoveFile(db.f.Name())
-	db.Update(func(tx *jdb.Tx) error {
-		return tx.Set("a", jdb.Value("a"))
-	})
+		check := func(db *jdb.DB, n int) {
+			for i := 1; i <= n; i++ {
+				k := strconv.Itoa(i)
+				if v := db.Get(k).String(); v != "v"+k {
+					t.Errorf("%s: %s: expected %q, got %q", c.name, k, "v"+k, v)
+				}
+			}
+		}
 
-	if err := db.Read(func(tx *jdb.Tx) error {
-		if tx.Get("a") == nil {
-			t.Error("couldn't get a")
+		db := getJDB(t, fp, c.be)
+		check(db, 5)
+		if err = db.Set("6", jdb.Value("v6")); err != nil {
+			t.Fatal(c.name, err)
 		}
-		return tx.Set("a", []byte("a"))
-	}); err != jdb.ErrReadOnly {
-		t.Fatal("expected ErrReadOnly, got", err)
+		db.Close()
+
+		// appending has to end the old member first
+		db = getJDB(t, fp, c.be)
+		check(db, 6)
+		db.Close()
 	}
+}
 
-	db.Update(func(tx *jdb.Tx) error {
-		tx.Set("b", []byte("b"))
-		return tx.Delete("a")
-	})
+func TestChecksum(t *testing.T) {
+	for _, c := range backends {
+		fp := tmpPath("checksum-" + c.name + ".jdb")
+		opts := &jdb.Opts{Backend: c.be, Checksum: true}
+		db, err := jdb.New(fp, opts)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		for i := 1; i <= 3; i++ {
+			db.Set(strconv.Itoa(i), jdb.Value("v"))
+		}
+		if vr, err := db.Verify(); err != nil || vr.Records != 3 || len(vr.Corrupt) != 0 {
+			t.Fatalf("%s: unexpected report: %+v %v", c.name, vr, err)
+		}
+		db.Close()
 
-	db.Read(func(tx *jdb.Tx) error {
-		if tx.Get("a") != nil {
-			t.Error("got a when we shouldn't have")
+		b, err := ioutil.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// flip a byte in the payload of the second transaction, the frame header is 28 bytes
+		hs := headerSize(t, fp)
+		off := hs + 28 + int(binary.LittleEndian.Uint32(b[hs+4:]))
+		b[off+28+2] ^= 0xff
+		if err = ioutil.WriteFile(fp, b, 0600); err != nil {
+			t.Fatal(err)
 		}
-		return nil
-	})
 
-	if err := db.Compact(); err != nil {
+		vr, err := jdb.Verify(fp)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if vr.Records != 2 || len(vr.Corrupt) != 1 {
+			t.Fatalf("%s: unexpected report: %+v", c.name, vr)
+		}
+		if re := vr.Corrupt[0]; re.Offset != int64(off) || re.Index != 2 || re.Err != jdb.ErrChecksum {
+			t.Fatalf("%s: unexpected error: %v", c.name, re)
+		}
+
+		if _, err = jdb.New(fp, opts); err == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+		if re, ok := err.(*jdb.RecordError); !ok || re.Index != 2 || re.Err != jdb.ErrChecksum {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		// the third transaction is intact, so it isn't a torn write
+		if _, err = jdb.New(fp, &jdb.Opts{Backend: c.be, Checksum: true, Recovery: jdb.RecoveryTruncateTorn}); err == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+		if vr, err := jdb.Verify(fp); err != nil || vr.Records != 2 || len(vr.Corrupt) != 1 {
+			t.Fatalf("%s: the file was modified: %+v %v", c.name, vr, err)
+		}
+	}
+}
+
+// checksumFile writes three transactions to a new file with checksums and returns its contents
+// and the offset of the second frame.
+func checksumFile(t *testing.T, fp string) ([]byte, int) {
+	db, err := jdb.New(fp, &jdb.Opts{Checksum: true})
+	if err != nil {
 		t.Fatal(err)
 	}
+	for i := 1; i <= 3; i++ {
+		db.Set(strconv.Itoa(i), jdb.Value("v"))
+	}
 	db.Close()
 
-	var err error
-	if db, err = jdb.New(fp, &jdb.Opts{Backend: jdb.GZipJSONBackend}); err != nil {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
 		t.Fatal(err)
 	}
+	hs := headerSize(t, fp)
+	return b, hs + 28 + int(binary.LittleEndian.Uint32(b[hs+4:]))
+}
 
-	db.Update(func(tx *jdb.Tx) error {
-		tx.Bucket("parent").Bucket("child").Set("the punisher", jdb.Value("coolest hero"))
-		return tx.Set("c", []byte("c"))
-	})
-
-	db.Read(func(tx *jdb.Tx) error {
-		if tx.Get("b") == nil {
-			t.Error("coudln't load b :(")
-		}
-		b := tx.Bucket("parent").Bucket("child")
-		if b.Get("the punisher") == nil {
-			t.Error("NOOOOOOO")
-		}
-		return nil
-	})
+func TestFrameSize(t *testing.T) {
+	fp := tmpPath("frame-size.jdb")
+	b, off := checksumFile(t, fp)
+	// a flipped bit in the size of the second frame claims a 2GiB payload
+	b[off+4+3] ^= 0x80
+	if err := ioutil.WriteFile(fp, b, 0600); err != nil {
+		t.Fatal(err)
+	}
 
-	db.Close()
+	_, err := jdb.New(fp, &jdb.Opts{Checksum: true})
+	if re, ok := err.(*jdb.RecordError); !ok || re.Index != 2 || re.Err != jdb.ErrBadFrame {
+		t.Fatalf("unexpected error: %v", err)
+	}
 }
 
-func TestCryptoBackend(t *testing.T) {
-	fp := filepath.Join(tmpDir, "crypto-gzip-json.jdb")
-	opts := &jdb.Opts{Backend: crypto.AESBackend(jdb.GZipJSONBackend, key[:])}
-	db, err := jdb.New(fp, opts)
-	if err != nil {
-		t.Fatal(fp, err)
-	}
-	for i := 0; i < 10; i++ {
-		bn := "bucket-" + strconv.Itoa(i)
-		if err := db.Update(func(tx *jdb.Tx) error {
-			b := tx.Bucket(bn)
-			for i := 0; i < 100; i++ {
-				kn := strconv.Itoa(i)
-				b.Set(kn, jdb.Value(kn))
-			}
-			return nil
-		}); err != nil {
-			t.Fatal(err)
-		}
+func TestVerifyFirstFrame(t *testing.T) {
+	fp := tmpPath("verify-first.jdb")
+	b, _ := checksumFile(t, fp)
+	// the header says the file has checksums, so a broken first frame is corruption
+	b[headerSize(t, fp)] = 'x'
+	if err := ioutil.WriteFile(fp, b, 0600); err != nil {
+		t.Fatal(err)
 	}
-	db.Close()
-	db, err = jdb.New(fp, opts)
+
+	vr, err := jdb.Verify(fp)
 	if err != nil {
-		t.Fatal(fp, err)
+		t.Fatal(err)
+	}
+	if vr.Records != 2 || len(vr.Corrupt) != 1 || vr.Corrupt[0].Err != jdb.ErrBadFrame {
+		t.Fatalf("unexpected report: %+v", vr)
 	}
-	db.Read(func(tx *jdb.Tx) error {
-		for i := 0; i < 10; i++ {
-			bn := "bucket-" + strconv.Itoa(i)
-			b := tx.Bucket(bn)
-			for i := 0; i < 100; i++ {
-				kn := strconv.Itoa(i)
-				if v := b.Get(kn); v.String() != kn {
-					t.Errorf("expected %s, got %s", kn, v)
-				}
-			}
-		}
-		return nil
-	})
-	db.Close()
 }
 
 func benchJDB(b *testing.B, name string, sameTx bool, be func() jdb.Backend) {
 	name = strconv.Itoa(rand.Int()) + "-" + name
-	db, err := jdb.New(filepath.Join(tmpDir, name), nil)
+	fp := filepath.Join(tmpDir, name)
+	db, err := jdb.New(fp, &jdb.Opts{Backend: be})
 	if err != nil {
 		b.Fatal(name, err)
 	}
-	defer db.Close()
+	defer func() {
+		if st, err := os.Stat(fp); err == nil {
+			b.ReportMetric(float64(st.Size())/float64(b.N), "file-B/op")
+		}
+		db.Close()
+	}()
 	var testFn func(pb *testing.PB)
 	if sameTx {
 		testFn = func(pb *testing.PB) {
@@ -205,6 +2240,33 @@ func BenchmarkJDBSameTxReadWriteCryptoGzipJSON(b *testing.B) {
 	benchJDB(b, "SameTxReadWriteCryptoGzipJSON", true, be)
 }
 
+func BenchmarkJDBSameTxReadWriteMsgpack(b *testing.B) {
+	benchJDB(b, "SameTxReadWriteMsgpack", true, msgpack.Backend)
+}
+
+func BenchmarkJDBSameTxReadWriteGzipMsgpack(b *testing.B) {
+	be := func() jdb.Backend { return jdb.GZipBackend(msgpack.Backend()) }
+	benchJDB(b, "SameTxReadWriteGzipMsgpack", true, be)
+}
+
+func BenchmarkJDBSameTxReadWriteGob(b *testing.B) {
+	benchJDB(b, "SameTxReadWriteGob", true, jdb.GobBackend)
+}
+
+func BenchmarkJDBSameTxReadWriteCBOR(b *testing.B) {
+	benchJDB(b, "SameTxReadWriteCBOR", true, cbor.Backend)
+}
+
+func BenchmarkJDBSameTxReadWriteZstdJSON(b *testing.B) {
+	be := func() jdb.Backend { return compress.ZstdBackend(jdb.JSONBackend(), nil) }
+	benchJDB(b, "SameTxReadWriteZstdJSON", true, be)
+}
+
+func BenchmarkJDBSameTxReadWriteLZ4JSON(b *testing.B) {
+	be := func() jdb.Backend { return compress.LZ4Backend(jdb.JSONBackend()) }
+	benchJDB(b, "SameTxReadWriteLZ4JSON", true, be)
+}
+
 func initBolt(name string) (*bolt.DB, error) {
 	db, err := bolt.Open(filepath.Join(tmpDir, name), 0644, nil)
 	if err != nil {
@@ -256,6 +2318,33 @@ func BenchmarkJDBSeparateReadWriteCryptoGzipJSON(b *testing.B) {
 	benchJDB(b, "SeparateTxReadWriteCryptoGzipJSON", false, be)
 }
 
+func BenchmarkJDBSeparateReadWriteMsgpack(b *testing.B) {
+	benchJDB(b, "SeparateTxReadWriteMsgpack", false, msgpack.Backend)
+}
+
+func BenchmarkJDBSeparateReadWriteGzipMsgpack(b *testing.B) {
+	be := func() jdb.Backend { return jdb.GZipBackend(msgpack.Backend()) }
+	benchJDB(b, "SeparateTxReadWriteGzipMsgpack", false, be)
+}
+
+func BenchmarkJDBSeparateReadWriteGob(b *testing.B) {
+	benchJDB(b, "SeparateTxReadWriteGob", false, jdb.GobBackend)
+}
+
+func BenchmarkJDBSeparateReadWriteCBOR(b *testing.B) {
+	benchJDB(b, "SeparateTxReadWriteCBOR", false, cbor.Backend)
+}
+
+func BenchmarkJDBSeparateReadWriteZstdJSON(b *testing.B) {
+	be := func() jdb.Backend { return compress.ZstdBackend(jdb.JSONBackend(), nil) }
+	benchJDB(b, "SeparateTxReadWriteZstdJSON", false, be)
+}
+
+func BenchmarkJDBSeparateReadWriteLZ4JSON(b *testing.B) {
+	be := func() jdb.Backend { return compress.LZ4Backend(jdb.JSONBackend()) }
+	benchJDB(b, "SeparateTxReadWriteLZ4JSON", false, be)
+}
+
 func BenchmarkBoltSeparateReadWrite(b *testing.B) {
 	db, err := initBolt("bench-rw.bolt")
 	if err != nil {
@@ -279,3 +2368,216 @@ func BenchmarkBoltSeparateReadWrite(b *testing.B) {
 		}
 	})
 }
+
+func benchJDBBatch(b *testing.B, name string, be func() jdb.Backend) {
+	name = strconv.Itoa(rand.Int()) + "-" + name
+	db, err := jdb.New(filepath.Join(tmpDir, name), &jdb.Opts{Backend: be})
+	if err != nil {
+		b.Fatal(name, err)
+	}
+	defer db.Close()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := db.Batch(func(tx *jdb.Tx) error {
+				return tx.Set("value", []byte("value"))
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkJDBBatchJSON(b *testing.B) {
+	benchJDBBatch(b, "BatchJSON", jdb.JSONBackend)
+}
+
+func BenchmarkJDBBatchMsgpack(b *testing.B) {
+	benchJDBBatch(b, "BatchMsgpack", msgpack.Backend)
+}
+
+func BenchmarkBoltBatch(b *testing.B) {
+	db, err := initBolt(strconv.Itoa(rand.Int()) + "-bench-batch.bolt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := db.Batch(func(tx *bolt.Tx) error {
+				return tx.Bucket(boltDefaultBucket).Put([]byte("value"), []byte("value"))
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func benchJDBSync(b *testing.B, name string, mode jdb.SyncMode) {
+	name = strconv.Itoa(rand.Int()) + "-" + name
+	db, err := jdb.New(filepath.Join(tmpDir, name), &jdb.Opts{SyncMode: mode})
+	if err != nil {
+		b.Fatal(name, err)
+	}
+	defer db.Close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := db.Set("value", []byte("value")); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkJDBSyncAlways(b *testing.B) {
+	benchJDBSync(b, "SyncAlways", jdb.SyncAlways)
+}
+
+func BenchmarkJDBSyncEvery10ms(b *testing.B) {
+	benchJDBSync(b, "SyncEvery10ms", jdb.SyncEvery(10*time.Millisecond))
+}
+
+func BenchmarkJDBSyncNever(b *testing.B) {
+	benchJDBSync(b, "SyncNever", jdb.SyncNever)
+}
+
+// benchReadUnderLoad measures Get while writers commit transactions in the background,
+// every writer adds a key to a new bucket, so every commit changes the tree.
+func benchReadUnderLoad(b *testing.B, name string, writers int, be func() jdb.Backend) {
+	name = strconv.Itoa(rand.Int()) + "-" + name
+	db, err := jdb.New(filepath.Join(tmpDir, name), &jdb.Opts{Backend: be})
+	if err != nil {
+		b.Fatal(name, err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		db.Set(strconv.Itoa(i), []byte("value"), "read")
+	}
+
+	var (
+		wg     sync.WaitGroup
+		done   = make(chan struct{})
+		writes int64
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				db.Set(strconv.Itoa(n), []byte("value"), "write-"+strconv.Itoa(i))
+				atomic.AddInt64(&writes, 1)
+			}
+		}(i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if string(db.Get(strconv.Itoa(r.Intn(1000)), "read")) != "value" {
+				b.Fatal("something went wrong")
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+	b.ReportMetric(float64(atomic.LoadInt64(&writes))/b.Elapsed().Seconds(), "writes/s")
+}
+
+func BenchmarkJDBReadNoWriteLoad(b *testing.B) {
+	benchReadUnderLoad(b, "ReadNoWriteLoad", 0, jdb.JSONBackend)
+}
+
+func BenchmarkJDBReadUnderWriteLoad(b *testing.B) {
+	benchReadUnderLoad(b, "ReadUnderWriteLoad", 4, jdb.JSONBackend)
+}
+
+func BenchmarkJDBReadUnderWriteLoadMsgpack(b *testing.B) {
+	benchReadUnderLoad(b, "ReadUnderWriteLoadMsgpack", 4, msgpack.Backend)
+}
+
+func benchBoltReadUnderLoad(b *testing.B, name string, writers int) {
+	db, err := initBolt(strconv.Itoa(rand.Int()) + "-" + name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltDefaultBucket)
+		for i := 0; i < 1000; i++ {
+			bkt.Put([]byte(strconv.Itoa(i)), []byte("value"))
+		}
+		return nil
+	})
+
+	var (
+		wg     sync.WaitGroup
+		done   = make(chan struct{})
+		writes int64
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				db.Update(func(tx *bolt.Tx) error {
+					bkt, err := tx.CreateBucketIfNotExists([]byte("write-" + strconv.Itoa(i)))
+					if err != nil {
+						return err
+					}
+					return bkt.Put([]byte(strconv.Itoa(n)), []byte("value"))
+				})
+				atomic.AddInt64(&writes, 1)
+			}
+		}(i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			var val string
+			db.View(func(tx *bolt.Tx) error {
+				val = string(tx.Bucket(boltDefaultBucket).Get([]byte(strconv.Itoa(r.Intn(1000)))))
+				return nil
+			})
+			if val != "value" {
+				b.Fatal("something went wrong")
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+	b.ReportMetric(float64(atomic.LoadInt64(&writes))/b.Elapsed().Seconds(), "writes/s")
+}
+
+func BenchmarkBoltReadNoWriteLoad(b *testing.B) {
+	benchBoltReadUnderLoad(b, "bench-read-idle.bolt", 0)
+}
+
+func BenchmarkBoltReadUnderWriteLoad(b *testing.B) {
+	benchBoltReadUnderLoad(b, "bench-read-load.bolt", 4)
+}
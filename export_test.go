@@ -0,0 +1,10 @@
+package jdb
+
+import "os"
+
+// SetFsync replaces the function used to sync database files and returns a function that restores it.
+func SetFsync(fn func(f *os.File) error) (restore func()) {
+	old := fsync
+	fsync = fn
+	return func() { fsync = old }
+}
@@ -0,0 +1,261 @@
+package jdb
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var errStopped = errors.New("stopped following")
+
+// Follow opens the database at fp read-only and keeps applying the transactions another process appends to it,
+// the file is polled every Opts.FollowInterval. If the writer replaces the file, for example with Compact, it's reloaded.
+// The file isn't locked, so it can be followed while a writer has it open, see DB.FollowErr.
+func Follow(fp string, opts *Opts) (*DB, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	db := newMemDB(fp, opts)
+	fl := &follower{
+		db:    db,
+		done:  make(chan struct{}),
+		ready: make(chan error, 1),
+	}
+	db.follower = fl
+
+	fl.wg.Add(1)
+	go fl.run(f)
+
+	if err = <-fl.ready; err != nil {
+		fl.stop()
+		return nil, err
+	}
+	return db, nil
+}
+
+// FollowErr returns the error that stopped a database opened with Follow from following its file,
+// the database keeps the last state it loaded.
+func (db *DB) FollowErr() error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	if db.follower == nil {
+		return nil
+	}
+	return db.follower.err
+}
+
+type follower struct {
+	db    *DB
+	done  chan struct{}
+	once  sync.Once
+	wg    sync.WaitGroup
+	ready chan error // receives the result of the initial load
+
+	// the state of the file being followed, it's published to db once everything in the file was read
+	f        *os.File
+	be       Backend
+	hdr      *Header
+	root     *node
+	live     bool // root is the database's current state
+	replaced bool
+	loaded   bool // the initial state was published
+
+	err error // guarded by db.mux
+}
+
+func (fl *follower) run(f *os.File) {
+	defer fl.wg.Done()
+
+	for {
+		err := fl.follow(f)
+		if fl.stopped() {
+			break
+		}
+
+		if !fl.replaced {
+			fl.fail(err)
+			break
+		}
+
+		if f != fl.db.f {
+			f.Close()
+		}
+		if f, err = fl.reopen(); err != nil {
+			return
+		}
+	}
+
+	if f != fl.db.f {
+		f.Close()
+	}
+}
+
+// follow loads f and applies new transactions as they are appended, until it's stopped or f gets replaced.
+func (fl *follower) follow(f *os.File) error {
+	fl.f, fl.hdr, fl.root, fl.live, fl.replaced = f, nil, nil, false, false
+
+	br := bufio.NewReader(&tailReader{fl, f})
+	h, err := readHeader(br)
+	if err != nil {
+		return err
+	}
+
+	fl.be = fl.db.opts.Backend()
+	checksum := fl.db.opts.Checksum
+	if h != nil {
+		if err = h.check(fl.be); err != nil {
+			return err
+		}
+		fl.hdr, checksum = h, h.Checksum
+	}
+
+	if _, err = initBackend(fl.be, ioutil.Discard, br, checksum); err != nil {
+		return err
+	}
+
+	for {
+		var tx fileTx
+		if err = fl.be.Decode(&tx); err != nil {
+			return err
+		}
+		if err = fl.apply(&tx); err != nil {
+			return err
+		}
+	}
+}
+
+func (fl *follower) apply(tx *fileTx) (err error) {
+	if fl.root, err = fl.db.replayTx(tx, fl.root); err == nil && fl.live {
+		fl.db.root.Store(fl.root)
+	}
+	return err
+}
+
+// publish replaces the state of the database with the file being followed, once it was read to the end.
+func (fl *follower) publish() {
+	db := fl.db
+	if fl.live {
+		return
+	}
+
+	if fl.root == nil {
+		fl.root = &node{}
+	}
+
+	db.mux.Lock()
+	old := db.f
+	db.f, db.be, db.hdr = fl.f, fl.be, fl.hdr
+	db.root.Store(fl.root)
+	fl.live = true
+	db.mux.Unlock()
+
+	if old != nil && old != fl.f {
+		old.Close()
+	}
+
+	if !fl.loaded {
+		fl.loaded = true
+		fl.ready <- nil
+	}
+}
+
+// wait is called every time the reader is at the end of the file.
+func (fl *follower) wait(f *os.File) error {
+	fl.publish()
+
+	select {
+	case <-fl.done:
+		return errStopped
+	case <-time.After(fl.db.opts.FollowInterval):
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// the writer compacted or repaired the file, or rolled back a transaction we already read part of
+	if pst, err := os.Stat(fl.db.name); err == nil && !os.SameFile(st, pst) || st.Size() < off {
+		fl.replaced = true
+		return errReplaced
+	}
+	return nil
+}
+
+var errReplaced = errors.New("the file was replaced")
+
+// reopen opens the file that replaced the one being followed.
+func (fl *follower) reopen() (*os.File, error) {
+	for {
+		f, err := os.Open(fl.db.name)
+		if err == nil {
+			return f, nil
+		}
+
+		// the file may be missing for a moment while it's replaced
+		if !os.IsNotExist(err) {
+			fl.fail(err)
+			return nil, err
+		}
+
+		select {
+		case <-fl.done:
+			return nil, errStopped
+		case <-time.After(fl.db.opts.FollowInterval):
+		}
+	}
+}
+
+// fail records the error that stopped following.
+func (fl *follower) fail(err error) {
+	if !fl.loaded {
+		fl.ready <- err
+		return
+	}
+
+	fl.db.mux.Lock()
+	fl.err = err
+	fl.db.mux.Unlock()
+}
+
+func (fl *follower) stopped() bool {
+	select {
+	case <-fl.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (fl *follower) stop() {
+	fl.once.Do(func() { close(fl.done) })
+	fl.wg.Wait()
+}
+
+// tailReader waits for more data at the end of the file instead of returning io.EOF.
+type tailReader struct {
+	fl *follower
+	f  *os.File
+}
+
+func (r *tailReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || err != nil && err != io.EOF {
+			return n, err
+		}
+		if err = r.fl.wait(r.f); err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package jdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// When Opts.Checksum is set, every encoded transaction is wrapped in a frame:
+//
+//	magic [4]byte | size uint32 | index uint64 | ts int64 | crc uint32 | payload [size]byte
+//
+// The CRC-32C covers the size, index, ts and payload, all integers are little endian.
+// The backend never sees the frames, it reads and writes a stream of concatenated payloads.
+const (
+	frameMagic      = "jdbf"
+	frameHeaderSize = 28
+	frameSumOffset  = 24
+)
+
+var (
+	ErrChecksum    = errors.New("checksum mismatch")
+	ErrBadFrame    = errors.New("invalid transaction frame")
+	ErrNoChecksums = errors.New("the file doesn't have checksums")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// RecordError describes a corrupt transaction, Index and Time are read from the frame
+// and may be wrong if the frame header itself got corrupted.
+type RecordError struct {
+	Offset int64
+	Index  uint64
+	Time   time.Time
+	Err    error
+}
+
+func (re *RecordError) Error() string {
+	return fmt.Sprintf("transaction %d (%v) at offset %d: %v", re.Index, re.Time, re.Offset, re.Err)
+}
+
+type frameHeader []byte
+
+func (h frameHeader) valid() bool   { return string(h[:4]) == frameMagic }
+func (h frameHeader) size() int64   { return int64(binary.LittleEndian.Uint32(h[4:])) }
+func (h frameHeader) index() uint64 { return binary.LittleEndian.Uint64(h[8:]) }
+func (h frameHeader) ts() int64     { return int64(binary.LittleEndian.Uint64(h[16:])) }
+func (h frameHeader) sum() uint32   { return binary.LittleEndian.Uint32(h[frameSumOffset:]) }
+
+func (h frameHeader) err(off int64, err error) *RecordError {
+	return &RecordError{off, h.index(), time.Unix(h.ts(), 0), err}
+}
+
+// frameWriter buffers everything the backend writes until writeFrame is called.
+type frameWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) { return fw.buf.Write(p) }
+
+// writeFrame writes everything buffered since the last call as a single frame.
+func (fw *frameWriter) writeFrame(index uint64, ts int64) error {
+	payload := fw.buf.Bytes()
+	b := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	copy(b, frameMagic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(b[8:], index)
+	binary.LittleEndian.PutUint64(b[16:], uint64(ts))
+
+	sum := crc32.Update(crc32.Checksum(b[4:frameSumOffset], castagnoli), castagnoli, payload)
+	binary.LittleEndian.PutUint32(b[frameSumOffset:], sum)
+
+	_, err := fw.w.Write(append(b, payload...))
+	fw.buf.Reset()
+	return err
+}
+
+// reset discards the data of a failed transaction.
+func (fw *frameWriter) reset() { fw.buf.Reset() }
+
+// frameReader verifies every frame and returns the payloads.
+type frameReader struct {
+	r   io.Reader
+	off int64
+	buf []byte
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for len(fr.buf) == 0 {
+		if err := fr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, fr.buf)
+	fr.buf = fr.buf[n:]
+	return n, nil
+}
+
+func (fr *frameReader) next() error {
+	h := make(frameHeader, frameHeaderSize)
+	if _, err := io.ReadFull(fr.r, h); err != nil {
+		return err
+	}
+	if !h.valid() {
+		return h.err(fr.off, ErrBadFrame)
+	}
+
+	// the size isn't verified yet, so copy the payload rather than allocating all of it up front
+	var rec bytes.Buffer
+	if _, err := io.CopyN(&rec, fr.r, h.size()); err != nil {
+		if err == io.EOF {
+			return h.err(fr.off, ErrBadFrame)
+		}
+		return err
+	}
+
+	payload := rec.Bytes()
+	if crc32.Update(crc32.Checksum(h[4:frameSumOffset], castagnoli), castagnoli, payload) != h.sum() {
+		return h.err(fr.off, ErrChecksum)
+	}
+
+	fr.off += frameHeaderSize + h.size()
+	fr.buf = payload
+	return nil
+}
+
+// VerifyReport is returned by Verify.
+type VerifyReport struct {
+	Size    int64          // the size of the file
+	Records int            // the number of good transactions
+	Corrupt []*RecordError // the corrupt transactions, in file order
+}
+
+// Verify checks the checksum of every transaction in the database file without decoding them,
+// the file must have been written with Opts.Checksum.
+func (db *DB) Verify() (*VerifyReport, error) {
+	if !db.opts.Checksum {
+		return nil, ErrNoChecksums
+	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return Verify(db.name)
+}
+
+// Verify checks the checksum of every transaction in the file at fp without decoding them,
+// unlike DB.Verify it doesn't need to open the database so it works on files New refuses to load.
+// After a corrupt frame it looks for the next one, so it can report more than one corrupt transaction.
+func Verify(fp string) (*VerifyReport, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := readFileHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var start int64
+	if fh != nil {
+		if !fh.Checksum {
+			return nil, ErrNoChecksums
+		}
+		start = fh.size()
+	}
+
+	vr := &VerifyReport{Size: st.Size()}
+	for off := start; off < vr.Size; {
+		h, err := checkFrame(f, off, vr.Size)
+		switch {
+		case err == nil:
+			vr.Records++
+		case err == ErrChecksum:
+			vr.Corrupt = append(vr.Corrupt, h.err(off, err))
+		case err == ErrBadFrame && off == start && fh == nil:
+			// files without a header only have checksums if they start with a frame
+			return nil, ErrNoChecksums
+		case h == nil && err == io.ErrUnexpectedEOF:
+			// not even a whole frame header is left
+			vr.Corrupt = append(vr.Corrupt, &RecordError{Offset: off, Err: err})
+			return vr, nil
+		case isFrameError(err):
+			vr.Corrupt = append(vr.Corrupt, h.err(off, err))
+			if off, err = nextFrame(f, off+1); err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			return nil, err
+		}
+		off += frameHeaderSize + h.size()
+	}
+
+	return vr, nil
+}
+
+// checkFrame reads the header of the frame at off in a file of the given size and verifies its checksum,
+// the header is nil if the file ends before it.
+func checkFrame(f *os.File, off, size int64) (frameHeader, error) {
+	h := make(frameHeader, frameHeaderSize)
+	if _, err := f.ReadAt(h, off); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if !h.valid() {
+		return h, ErrBadFrame
+	}
+	if off+frameHeaderSize+h.size() > size {
+		return h, io.ErrUnexpectedEOF
+	}
+
+	sum := crc32.New(castagnoli)
+	sum.Write(h[4:frameSumOffset])
+	if _, err := io.Copy(sum, io.NewSectionReader(f, off+frameHeaderSize, h.size())); err != nil {
+		return h, err
+	}
+	if sum.Sum32() != h.sum() {
+		return h, ErrChecksum
+	}
+	return h, nil
+}
+
+func isFrameError(err error) bool {
+	return err == ErrBadFrame || err == ErrChecksum || err == io.ErrUnexpectedEOF
+}
+
+// nextFrame returns the offset of the next frame magic at or after off, or the size of the file if there isn't one.
+func nextFrame(f *os.File, off int64) (int64, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.ReadAt(buf, off)
+		if i := bytes.Index(buf[:n], []byte(frameMagic)); i != -1 {
+			return off + int64(i), nil
+		}
+		if err == io.EOF {
+			return off + int64(n), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		// keep the tail in case the magic spans two reads
+		off += int64(n - len(frameMagic) + 1)
+	}
+}
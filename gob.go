@@ -0,0 +1,241 @@
+package jdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+)
+
+// GobBackend returns an encoding/gob backend, objects stored with SetObject keep their exact Go types.
+//
+// Gob streams can't be appended to by a new encoder, so every transaction is written as a record:
+//
+//	kind uint8 | size uvarint | gob data [size]byte
+//
+// and the first record written by an encoder starts a new gob stream.
+func GobBackend() Backend { return &gobBackend{} }
+
+const (
+	gobRecord uint8 = iota
+	gobStream       // the record starts a new gob stream
+)
+
+// gob can't encode nil map elements, deletions are stored separately.
+type gobTx struct {
+	Index     uint64
+	TS        int64
+	Changeset *gobBucket
+	Compact   bool
+}
+
+type gobBucket struct {
+	Buckets        map[string]*gobBucket
+	DeletedBuckets []string
+	Data           map[string][]byte
+	DeletedKeys    []string
+	Seq            uint64
+}
+
+func toGob(b *bucket) *gobBucket {
+	if b == nil {
+		return nil
+	}
+
+	gb := &gobBucket{Seq: b.Seq}
+	for k, v := range b.Data {
+		if v == nil {
+			gb.DeletedKeys = append(gb.DeletedKeys, k)
+			continue
+		}
+		if gb.Data == nil {
+			gb.Data = make(map[string][]byte, len(b.Data))
+		}
+		gb.Data[k] = v
+	}
+
+	for bn, cb := range b.Buckets {
+		if cb == nil {
+			gb.DeletedBuckets = append(gb.DeletedBuckets, bn)
+			continue
+		}
+		if gb.Buckets == nil {
+			gb.Buckets = make(map[string]*gobBucket, len(b.Buckets))
+		}
+		gb.Buckets[bn] = toGob(cb)
+	}
+
+	return gb
+}
+
+func fromGob(gb *gobBucket) *bucket {
+	if gb == nil {
+		return nil
+	}
+
+	b := &bucket{Seq: gb.Seq}
+	if n := len(gb.Data) + len(gb.DeletedKeys); n > 0 {
+		b.Data = make(map[string]Value, n)
+	}
+	for k, v := range gb.Data {
+		b.Data[k] = v
+	}
+	for _, k := range gb.DeletedKeys {
+		b.Data[k] = nil
+	}
+
+	if n := len(gb.Buckets) + len(gb.DeletedBuckets); n > 0 {
+		b.Buckets = make(map[string]*bucket, n)
+	}
+	for bn, cb := range gb.Buckets {
+		b.Buckets[bn] = fromGob(cb)
+	}
+	for _, bn := range gb.DeletedBuckets {
+		b.Buckets[bn] = nil
+	}
+
+	return b
+}
+
+type gobBackend struct {
+	w    io.Writer
+	buf  bytes.Buffer
+	enc  *gob.Encoder
+	kind uint8
+
+	r        *bufio.Reader
+	dec      *gob.Decoder
+	rec      []byte
+	inStream bool  // the current decoder already read a record
+	next     int64 // the size of the record that starts the next stream, or -1
+}
+
+func (g *gobBackend) Init(w io.Writer, r io.Reader) error {
+	g.w, g.r, g.next = w, bufio.NewReader(r), -1
+	return nil
+}
+
+// Flush writes the buffered transaction as a single record.
+func (g *gobBackend) Flush() error {
+	if g.buf.Len() == 0 {
+		return nil
+	}
+
+	rec := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+g.buf.Len())
+	rec[0] = g.kind
+	rec = append(rec[:1+binary.PutUvarint(rec[1:], uint64(g.buf.Len()))], g.buf.Bytes()...)
+	g.buf.Reset()
+	g.kind = gobRecord
+
+	_, err := g.w.Write(rec)
+	return err
+}
+
+func (g *gobBackend) Encode(v interface{}) error {
+	if g.enc == nil {
+		g.enc, g.kind = gob.NewEncoder(&g.buf), gobStream
+	}
+
+	if tx, ok := v.(*fileTx); ok {
+		v = &gobTx{tx.Index, tx.TS, toGob(tx.Changeset), tx.Compact}
+	}
+
+	err := g.enc.Encode(v)
+	if err != nil {
+		// the encoder may think it already sent type definitions that are being discarded
+		g.buf.Reset()
+		g.enc = nil
+	}
+	return err
+}
+
+func (g *gobBackend) Decode(v interface{}) error {
+	tx, isTx := v.(*fileTx)
+	var gtx gobTx
+	if isTx {
+		v = &gtx
+	}
+
+	for {
+		if g.dec == nil {
+			g.dec, g.inStream = gob.NewDecoder(gobReader{g}), false
+		}
+
+		err := g.dec.Decode(v)
+		if err == io.EOF && g.next != -1 {
+			g.dec = nil
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	if isTx {
+		*tx = fileTx{gtx.Index, gtx.TS, fromGob(gtx.Changeset), gtx.Compact}
+	}
+	return nil
+}
+
+// readRecord reads the next record of the current stream, it returns io.EOF at the end of the stream.
+func (g *gobBackend) readRecord() error {
+	size := g.next
+	if size == -1 {
+		kind, err := g.r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		n, err := binary.ReadUvarint(g.r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		size = int64(n)
+
+		if kind == gobStream && g.inStream {
+			g.next = size
+			return io.EOF
+		}
+	}
+
+	var rec bytes.Buffer
+	if _, err := io.CopyN(&rec, g.r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	g.rec, g.next, g.inStream = rec.Bytes(), -1, true
+	return nil
+}
+
+func (g *gobBackend) BackendName() string { return "gob" }
+
+func (g *gobBackend) Marshal(in interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(in)
+	return buf.Bytes(), err
+}
+
+func (g *gobBackend) Unmarshal(in []byte, out interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(in)).Decode(out)
+}
+
+type gobReader struct{ g *gobBackend }
+
+func (r gobReader) Read(p []byte) (int, error) {
+	for len(r.g.rec) == 0 {
+		if err := r.g.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.g.rec)
+	r.g.rec = r.g.rec[n:]
+	return n, nil
+}
@@ -0,0 +1,194 @@
+package jdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Every file starts with a header identifying the format and the backend stack that wrote it:
+//
+//	magic [4]byte | version uint8 | flags uint8 | created int64 | n uint8 | backend [n]byte
+//
+// Files written before headers were added are still loaded, they just can't be checked,
+// Compact adds a header to them.
+const (
+	headerMagic     = "jdbh"
+	headerVersion   = 1
+	headerFixedSize = 15
+	headerMaxName   = 255
+
+	headerChecksum = 1 << 0
+)
+
+var (
+	ErrBackendMismatch = errors.New("the file was written with a different backend")
+	ErrNoHeader        = errors.New("the file doesn't have a header")
+	ErrBadHeader       = errors.New("invalid file header")
+)
+
+// Header describes a database file, see Probe.
+type Header struct {
+	Version  uint8
+	Backend  string // the backend stack that wrote the file, outermost first, e.g. "aes-cfb>gzip>json"
+	Created  time.Time
+	Checksum bool // transactions are wrapped in checksummed frames, see Opts.Checksum
+}
+
+// BackendNamer is implemented by backends that identify themselves in the file header,
+// wrappers include the name of the backend they wrap, e.g. "gzip>json".
+type BackendNamer interface {
+	BackendName() string
+}
+
+// BackendName returns the name be is recorded as in the file header,
+// it's empty if be doesn't implement BackendNamer.
+func BackendName(be Backend) string {
+	if bn, ok := be.(BackendNamer); ok {
+		return bn.BackendName()
+	}
+	return ""
+}
+
+// Probe returns the header of the database file at fp, or ErrNoHeader if it was written by an older version.
+func Probe(fp string) (*Header, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := readFileHeader(f)
+	if err == nil && h == nil {
+		err = ErrNoHeader
+	}
+	return h, err
+}
+
+func newHeader(be Backend, checksum bool, created time.Time) *Header {
+	if created.IsZero() {
+		created = time.Now()
+	}
+	name := BackendName(be)
+	if len(name) > headerMaxName {
+		name = name[:headerMaxName]
+	}
+	return &Header{
+		Version:  headerVersion,
+		Backend:  name,
+		Created:  created,
+		Checksum: checksum,
+	}
+}
+
+func (h *Header) size() int64 { return headerFixedSize + int64(len(h.Backend)) }
+
+// check returns ErrBackendMismatch if the file was written with a different backend than be.
+func (h *Header) check(be Backend) error {
+	if name := newHeader(be, false, h.Created).Backend; name != h.Backend {
+		return fmt.Errorf("%w: got %q, expected %q", ErrBackendMismatch, name, h.Backend)
+	}
+	return nil
+}
+
+func (h *Header) write(w io.Writer) error {
+	b := make([]byte, h.size())
+	copy(b, headerMagic)
+	b[4] = h.Version
+	if h.Checksum {
+		b[5] |= headerChecksum
+	}
+	binary.LittleEndian.PutUint64(b[6:], uint64(h.Created.Unix()))
+	b[14] = uint8(len(h.Backend))
+	copy(b[headerFixedSize:], h.Backend)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// readHeader reads the header from br, it returns a nil header and doesn't consume anything if there isn't one.
+func readHeader(br *bufio.Reader) (*Header, error) {
+	b, err := br.Peek(headerFixedSize)
+	if len(b) < len(headerMagic) || string(b[:len(headerMagic)]) != headerMagic {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ErrBadHeader
+	}
+
+	h := &Header{
+		Version:  b[4],
+		Checksum: b[5]&headerChecksum != 0,
+		Created:  time.Unix(int64(binary.LittleEndian.Uint64(b[6:])), 0),
+	}
+	if h.Version != headerVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadHeader, h.Version)
+	}
+
+	n := int(b[14])
+	if b, err = br.Peek(headerFixedSize + n); err != nil {
+		return nil, ErrBadHeader
+	}
+	h.Backend = string(b[headerFixedSize:])
+
+	_, err = br.Discard(len(b))
+	return h, err
+}
+
+// readFileHeader reads the header of f and leaves it positioned right after it, or at the start of the file if there isn't one.
+func readFileHeader(f *os.File) (*Header, error) {
+	h, err := readHeader(bufio.NewReader(io.NewSectionReader(f, 0, headerFixedSize+headerMaxName)))
+	if err != nil || h == nil {
+		return nil, err
+	}
+	_, err = f.Seek(h.size(), os.SEEK_SET)
+	return h, err
+}
+
+// initHeader writes the header of a new database file, or reads and checks the header of an existing one.
+// Opts.Checksum is ignored for existing files with a header, they keep the setting they were created with.
+func (db *DB) initHeader() error {
+	st, err := db.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if st.Size() == 0 {
+		if db.readOnly {
+			return nil
+		}
+		db.hdr = newHeader(db.be, db.opts.Checksum, time.Time{})
+		if err = db.hdr.write(db.f); err != nil {
+			return err
+		}
+		return fsync(db.f)
+	}
+
+	if db.hdr, err = readFileHeader(db.f); err != nil || db.hdr == nil {
+		return err
+	}
+	db.opts.Checksum = db.hdr.Checksum
+	return db.hdr.check(db.be)
+}
+
+// initFile writes a header to the new file f and initializes be with it.
+func initFile(f *os.File, be Backend, checksum bool, created time.Time) (*Header, *frameWriter, error) {
+	h := newHeader(be, checksum, created)
+	if err := h.write(f); err != nil {
+		return nil, nil, err
+	}
+	fw, err := initBackend(be, f, f, checksum)
+	return h, fw, err
+}
+
+// created returns the creation time recorded in the header, or the zero time if the file doesn't have one.
+func (db *DB) created() time.Time {
+	if db.hdr == nil {
+		return time.Time{}
+	}
+	return db.hdr.Created
+}
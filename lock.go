@@ -0,0 +1,60 @@
+package jdb
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrLocked is returned by New when another process, or another DB in the same process, has the file open.
+var ErrLocked = errors.New("the database file is locked by another process")
+
+const lockPollInterval = 10 * time.Millisecond
+
+// lockFile takes an exclusive or shared advisory lock on f,
+// it polls until timeout passes if the lock is held by someone else.
+func lockFile(f *os.File, exclusive bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := tryLockFile(f, exclusive)
+		if err != nil || ok {
+			return err
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return ErrLocked
+		}
+		if wait > lockPollInterval {
+			wait = lockPollInterval
+		}
+		time.Sleep(wait)
+	}
+}
+
+// openLocked opens and locks the file at fp, if the file got replaced while waiting for the lock,
+// for example by a Compact in another process, the new file is opened and locked instead.
+func openLocked(fp string, flag int, exclusive bool, timeout time.Duration) (*os.File, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(fp, flag, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = lockFile(f, exclusive, time.Until(deadline)); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if pst, err := os.Stat(fp); err == nil && os.SameFile(st, pst) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
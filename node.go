@@ -0,0 +1,124 @@
+package jdb
+
+// node is an immutable version of a bucket, every committed transaction publishes a new root node
+// that shares everything the transaction didn't touch with the previous one.
+// Readers use the root that was current when they started without taking any locks.
+type node struct {
+	buckets *pmap // *node
+	data    *pmap // Value
+	seq     uint64
+	size    int64 // the size of all the keys, values and bucket names in the tree
+}
+
+func (n *node) get(key string) Value {
+	if n == nil {
+		return nil
+	}
+	v, _ := n.data.get(key)
+	v2, _ := v.(Value)
+	return v2
+}
+
+func (n *node) bucket(name string) *node {
+	if n == nil {
+		return nil
+	}
+	b, _ := n.buckets.get(name)
+	nb, _ := b.(*node)
+	return nb
+}
+
+func (n *node) sequence() uint64 {
+	if n == nil {
+		return 0
+	}
+	return n.seq
+}
+
+// forEach calls fn for every key in the bucket until it returns false.
+func (n *node) forEach(fn func(key string, val Value) bool) {
+	if n == nil {
+		return
+	}
+	n.data.forEach(func(k string, v interface{}) bool { return fn(k, v.(Value)) })
+}
+
+// forEachBucket calls fn for every child bucket until it returns false.
+func (n *node) forEachBucket(fn func(name string, b *node) bool) {
+	if n == nil {
+		return
+	}
+	n.buckets.forEach(func(k string, v interface{}) bool { return fn(k, v.(*node)) })
+}
+
+// toBucket returns a copy of the tree as a bucket, it's used to write Compact snapshots.
+func (n *node) toBucket() *bucket {
+	b := &bucket{Seq: n.sequence()}
+	if n == nil {
+		return b
+	}
+
+	if l := n.data.len(); l > 0 {
+		b.Data = make(map[string]Value, l)
+		n.forEach(func(k string, v Value) bool {
+			b.Data[k] = v
+			return true
+		})
+	}
+
+	if l := n.buckets.len(); l > 0 {
+		b.Buckets = make(map[string]*bucket, l)
+		n.forEachBucket(func(k string, c *node) bool {
+			b.Buckets[k] = c.toBucket()
+			return true
+		})
+	}
+
+	return b
+}
+
+// apply returns a new version of n with the changes in src, nodes owned by ed are modified in place.
+func (n *node) apply(src *bucket, ed *edit, copyOnSet bool) *node {
+	var nn node
+	if n != nil {
+		nn = *n
+	}
+	if src == nil {
+		return &nn
+	}
+
+	if src.Seq > 0 {
+		nn.seq = src.Seq
+	}
+
+	for k, v := range src.Data {
+		if old, ok := nn.data.get(k); ok {
+			nn.size -= int64(len(k) + len(old.(Value)))
+		}
+		if v == nil {
+			nn.data = nn.data.del(k, ed)
+		} else {
+			if copyOnSet {
+				v = v.Copy()
+			}
+			nn.data = nn.data.set(k, v, ed)
+			nn.size += int64(len(k) + len(v))
+		}
+	}
+
+	for bn, b := range src.Buckets {
+		old := n.bucket(bn)
+		if old != nil {
+			nn.size -= int64(len(bn)) + old.size
+		}
+		if b == nil {
+			nn.buckets = nn.buckets.del(bn, ed)
+		} else {
+			c := old.apply(b, ed, copyOnSet)
+			nn.buckets = nn.buckets.set(bn, c, ed)
+			nn.size += int64(len(bn)) + c.size
+		}
+	}
+
+	return &nn
+}
@@ -1,15 +1,112 @@
 package jdb
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"encoding/json"
+	"hash/crc32"
 	"io"
+	"time"
 )
 
 type Opts struct {
 	Backend func() Backend
 
 	CopyOnSet bool
+
+	// ReplayFilter is called for every transaction read from the file by New, OpenAt and Replay,
+	// returning false skips the transaction and returning an error aborts loading the database.
+	// The filter may modify cs, Compact can be used to persist the filtered database.
+	ReplayFilter func(ti TxInfo, cs *ChangeSet) (keep bool, err error)
+
+	// ArchiveDir enables archiving, Compact will save a copy of the transaction log to ArchiveDir
+	// before replacing it, see DB.Archives.
+	ArchiveDir string
+	// CompressArchives gzips the archived segments.
+	CompressArchives bool
+
+	// Checksum wraps every transaction in a frame with a CRC-32C checksum, which is checked while loading,
+	// see Verify. It can't be toggled on an existing file, files with a header keep the setting they were created with.
+	Checksum bool
+
+	// Recovery controls what New does when a transaction in the file can't be decoded,
+	// usually because the process died while writing it, see DB.Recovery.
+	Recovery RecoveryMode
+
+	// ReadOnly opens an existing database without ever writing to the file, Update, Set and Compact return ErrReadOnly.
+	// The file is opened with a shared lock, any number of read-only processes can open it
+	// as long as no writer has it open, writers take an exclusive lock.
+	ReadOnly bool
+
+	// LockTimeout is how long New waits for another process to release the file before returning ErrLocked,
+	// by default it doesn't wait.
+	LockTimeout time.Duration
+
+	// FollowInterval is how often a database opened with Follow checks its file for changes, 100ms by default.
+	FollowInterval time.Duration
+
+	// MaxBatchSize is the maximum number of calls DB.Batch commits with a single fsync, 1000 by default.
+	MaxBatchSize int
+
+	// SyncMode controls when committed transactions are synced to disk, SyncAlways by default.
+	SyncMode SyncMode
+
+	// AutoCompact compacts the database in the background, see AutoCompact.
+	AutoCompact AutoCompact
+}
+
+// RecoveryMode is used by Opts.Recovery.
+type RecoveryMode uint8
+
+const (
+	// RecoveryFail makes New return the decoding error, this is the default.
+	RecoveryFail RecoveryMode = iota
+	// RecoveryTruncateTorn drops a torn final transaction and repairs the file, keeping a copy of the original
+	// with a ".corrupt" suffix, it acts like RecoveryIgnore if Opts.ReadOnly is set.
+	// A bad transaction followed by good ones is corruption rather than a torn write, New returns the error.
+	// Telling them apart needs the checksummed frames of Opts.Checksum, New fails without them.
+	RecoveryTruncateTorn
+	// RecoveryIgnore loads the good transactions and leaves the file as is, the database is opened read-only.
+	RecoveryIgnore
+)
+
+// SyncMode is used by Opts.SyncMode.
+type SyncMode time.Duration
+
+const (
+	// SyncAlways syncs the file before Update returns, a crash never loses a committed transaction.
+	SyncAlways SyncMode = 0
+	// SyncNever leaves writing the file to disk to the OS, it's only synced by DB.Sync and Close.
+	// A crash of the machine, not just the process, can lose everything since the last sync.
+	SyncNever SyncMode = -1
+)
+
+// SyncEvery returns a SyncMode that syncs the file from a background goroutine every d,
+// a crash can lose the transactions committed in the last d.
+func SyncEvery(d time.Duration) SyncMode {
+	if d <= 0 {
+		return SyncAlways
+	}
+	return SyncMode(d)
+}
+
+func (o *Opts) withDefaults() Opts {
+	var opts Opts
+	if o != nil {
+		opts = *o
+	}
+	if opts.Backend == nil {
+		opts.Backend = JSONBackend
+	}
+	if opts.FollowInterval <= 0 {
+		opts.FollowInterval = 100 * time.Millisecond
+	}
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = 1000
+	}
+	return opts
 }
 
 type flusher interface {
@@ -44,6 +141,8 @@ func (j *jsonBackend) Init(w io.Writer, r io.Reader) error {
 
 func (j *jsonBackend) Flush() error { return nil }
 
+func (j *jsonBackend) BackendName() string { return "json" }
+
 func (j *jsonBackend) Encode(v interface{}) error { return j.enc.Encode(v) }
 func (j *jsonBackend) Decode(v interface{}) error { return j.dec.Decode(v) }
 
@@ -57,34 +156,65 @@ func GZipBackend(be Backend) Backend { return GZipLevelBackend(be, gzip.DefaultC
 func GZipLevelBackend(be Backend, level int) Backend { return &gzipBackend{level: level, be: be} }
 
 type gzipBackend struct {
-	level int
-	be    Backend
-	gzw   *gzip.Writer
+	level  int
+	be     Backend
+	w      io.Writer
+	buf    bytes.Buffer
+	gzw    *gzip.Writer
+	zr     *gzipReader
+	dirty  bool
+	legacy []byte // ends the member left open by an older version, see Decode
 }
 
 func (g *gzipBackend) Init(w io.Writer, r io.Reader) (err error) {
-	if g.gzw, err = gzip.NewWriterLevel(w, g.level); err != nil {
-		return err
-	}
-	gzr := &gzip.Reader{}
-	if err = gzr.Reset(r); err != nil && err != io.EOF {
+	if g.gzw, err = gzip.NewWriterLevel(&g.buf, g.level); err != nil {
 		return err
 	}
-	return g.be.Init(g.gzw, gzr)
+	g.w = w
+	g.zr = &gzipReader{r: &lastReader{r: bufio.NewReader(r)}}
+	return g.be.Init(g.gzw, g.zr)
 }
 
+// Flush writes every transaction as a separate gzip member with a single write,
+// so a crash can only tear the last member and appending to the file is always safe.
+// Each member costs a gzip header, a trailer and starting over with an empty dictionary.
 func (g *gzipBackend) Flush() error {
 	if err := g.be.Flush(); err != nil {
 		return err
 	}
-	return g.gzw.Flush()
+	if !g.dirty {
+		return nil
+	}
+	if err := g.gzw.Close(); err != nil {
+		return err
+	}
+	b := g.buf.Bytes()
+	if g.legacy != nil {
+		b = append(g.legacy, b...)
+	}
+	_, err := g.w.Write(b)
+	g.buf.Reset()
+	g.gzw.Reset(&g.buf)
+	g.dirty, g.legacy = false, nil
+	return err
+}
+
+func (g *gzipBackend) Encode(v interface{}) error {
+	g.dirty = true
+	return g.be.Encode(v)
 }
 
-func (g *gzipBackend) Encode(v interface{}) error { return g.be.Encode(v) }
+// Decode also reads files written before every transaction got its own member,
+// those are a single member that was flushed after every transaction but only ended by Close,
+// which AESBackend never called and a crashed process never got to.
+// If the data stops right after such a flush the member is ended before anything is appended to it.
 func (g *gzipBackend) Decode(v interface{}) error {
 	err := g.be.Decode(v)
-	if err == io.ErrUnexpectedEOF { // because gzip likes to fuck with it....
-		err = io.EOF
+	switch {
+	case err == nil:
+		g.zr.decoded++
+	case err == io.ErrUnexpectedEOF && g.zr.unterminated():
+		g.legacy, err = g.zr.trailer(), io.EOF
 	}
 	return err
 }
@@ -92,8 +222,80 @@ func (g *gzipBackend) Decode(v interface{}) error {
 func (g *gzipBackend) Marshal(in interface{}) ([]byte, error)     { return g.be.Marshal(in) }
 func (g *gzipBackend) Unmarshal(in []byte, out interface{}) error { return g.be.Unmarshal(in, out) }
 
-func (j *gzipBackend) Close() error {
-	return j.gzw.Close()
+func (g *gzipBackend) Close() error { return g.Flush() }
+
+func (g *gzipBackend) BackendName() string { return "gzip>" + BackendName(g.be) }
+
+// gzipReader reads one member at a time, the next member header is only read once more data is needed,
+// so the last transaction can be decoded while the file is still being appended to, see Follow.
+type gzipReader struct {
+	r       *lastReader
+	gzr     gzip.Reader
+	started bool
+
+	decoded int    // the number of transactions decoded
+	from    int    // the number of transactions decoded before the current member started
+	sum     uint32 // the crc and size of the current member so far
+	size    uint32
+}
+
+func (z *gzipReader) Read(p []byte) (int, error) {
+	for {
+		if !z.started {
+			if err := z.gzr.Reset(z.r); err != nil {
+				return 0, err
+			}
+			z.gzr.Multistream(false)
+			z.started, z.from = true, z.decoded
+			z.sum, z.size = 0, 0
+		}
+
+		n, err := z.gzr.Read(p)
+		z.sum = crc32.Update(z.sum, crc32.IEEETable, p[:n])
+		z.size += uint32(n)
+		if err == io.EOF {
+			z.started, err = false, nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// unterminated reports whether the current member already held whole transactions
+// and its data ends with the marker of a sync flush, so it's complete but was never ended.
+func (z *gzipReader) unterminated() bool {
+	return z.started && z.from < z.decoded && z.r.last == 0x0000ffff
+}
+
+// trailer returns what ends the current member: an empty final stored block and the gzip trailer.
+func (z *gzipReader) trailer() []byte {
+	b := []byte{1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[5:], z.sum)
+	binary.LittleEndian.PutUint32(b[9:], z.size)
+	return b
+}
+
+// lastReader remembers the last 4 bytes read from r.
+type lastReader struct {
+	r    *bufio.Reader
+	last uint32
+}
+
+func (lr *lastReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	for _, c := range p[:n] {
+		lr.last = lr.last<<8 | uint32(c)
+	}
+	return n, err
+}
+
+func (lr *lastReader) ReadByte() (byte, error) {
+	c, err := lr.r.ReadByte()
+	if err == nil {
+		lr.last = lr.last<<8 | uint32(c)
+	}
+	return c, err
 }
 
 // GZipJSONBackend is a shorthand for GZipBackend(JSONBackend())
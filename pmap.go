@@ -0,0 +1,275 @@
+package jdb
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+// pmap is a persistent hash array mapped trie, changing it returns a new version that shares
+// everything but the path to the changed key with the old one, so old versions can be read concurrently.
+//
+// Nodes created with the same non-nil *edit are owned by it and changed in place,
+// an edit must not be used anymore once a version it built was published.
+type pmap struct {
+	root *pnode
+	n    int
+	edit *edit
+}
+
+type edit struct{ _ byte } // not zero sized, so every edit has a unique address
+
+const (
+	pmapBits = 5
+	pmapMask = 1<<pmapBits - 1
+)
+
+var pmapSeed = maphash.MakeSeed()
+
+type pnode struct {
+	bitmap uint32
+	kids   []pentry
+	edit   *edit
+}
+
+// pentry is either a child node or the leaves with the same hash, almost always only one.
+type pentry struct {
+	sub  *pnode
+	hash uint64
+	leaf []pleaf
+}
+
+type pleaf struct {
+	key string
+	val interface{}
+}
+
+func (m *pmap) len() int {
+	if m == nil {
+		return 0
+	}
+	return m.n
+}
+
+func (m *pmap) get(key string) (interface{}, bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	h := maphash.String(pmapSeed, key)
+	n := m.root
+	for shift := uint(0); n != nil; shift += pmapBits {
+		bit := uint32(1) << (h >> shift & pmapMask)
+		if n.bitmap&bit == 0 {
+			return nil, false
+		}
+
+		e := &n.kids[bits.OnesCount32(n.bitmap&(bit-1))]
+		if e.sub != nil {
+			n = e.sub
+			continue
+		}
+
+		if e.hash == h {
+			for _, l := range e.leaf {
+				if l.key == key {
+					return l.val, true
+				}
+			}
+		}
+		break
+	}
+	return nil, false
+}
+
+// forEach calls fn for every key until it returns false.
+func (m *pmap) forEach(fn func(key string, val interface{}) bool) {
+	if m != nil {
+		m.root.forEach(fn)
+	}
+}
+
+func (n *pnode) forEach(fn func(key string, val interface{}) bool) bool {
+	if n == nil {
+		return true
+	}
+	for i := range n.kids {
+		e := &n.kids[i]
+		if e.sub != nil {
+			if !e.sub.forEach(fn) {
+				return false
+			}
+			continue
+		}
+		for _, l := range e.leaf {
+			if !fn(l.key, l.val) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (m *pmap) editable(ed *edit) *pmap {
+	switch {
+	case m == nil:
+		return &pmap{edit: ed}
+	case ed != nil && m.edit == ed:
+		return m
+	default:
+		return &pmap{m.root, m.n, ed}
+	}
+}
+
+func (m *pmap) set(key string, val interface{}, ed *edit) *pmap {
+	m = m.editable(ed)
+	root, added := m.root.set(0, maphash.String(pmapSeed, key), key, val, ed)
+	m.root = root
+	if added {
+		m.n++
+	}
+	return m
+}
+
+// del returns a new version without key, or nil if it's empty.
+func (m *pmap) del(key string, ed *edit) *pmap {
+	if m == nil {
+		return nil
+	}
+
+	root, removed := m.root.del(0, maphash.String(pmapSeed, key), key, ed)
+	if !removed {
+		return m
+	}
+	if root == nil {
+		return nil
+	}
+
+	m = m.editable(ed)
+	m.root = root
+	m.n--
+	return m
+}
+
+func (n *pnode) editable(ed *edit) *pnode {
+	if ed != nil && n.edit == ed {
+		return n
+	}
+	return &pnode{n.bitmap, append([]pentry(nil), n.kids...), ed}
+}
+
+func (n *pnode) set(shift uint, h uint64, key string, val interface{}, ed *edit) (*pnode, bool) {
+	bit := uint32(1) << (h >> shift & pmapMask)
+	if n == nil {
+		return &pnode{bit, []pentry{{hash: h, leaf: []pleaf{{key, val}}}}, ed}, true
+	}
+
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	n = n.editable(ed)
+
+	if n.bitmap&bit == 0 {
+		n.kids = append(n.kids, pentry{})
+		copy(n.kids[i+1:], n.kids[i:])
+		n.kids[i] = pentry{hash: h, leaf: []pleaf{{key, val}}}
+		n.bitmap |= bit
+		return n, true
+	}
+
+	e := &n.kids[i]
+	switch {
+	case e.sub != nil:
+		var added bool
+		e.sub, added = e.sub.set(shift+pmapBits, h, key, val, ed)
+		return n, added
+
+	case e.hash == h:
+		leaf := append([]pleaf(nil), e.leaf...)
+		for j := range leaf {
+			if leaf[j].key == key {
+				leaf[j].val = val
+				e.leaf = leaf
+				return n, false
+			}
+		}
+		e.leaf = append(leaf, pleaf{key, val})
+		return n, true
+
+	default:
+		*e = pentry{sub: pairNode(shift+pmapBits, *e, pentry{hash: h, leaf: []pleaf{{key, val}}}, ed)}
+		return n, true
+	}
+}
+
+// pairNode returns a node holding two entries with different hashes.
+func pairNode(shift uint, a, b pentry, ed *edit) *pnode {
+	ai, bi := a.hash>>shift&pmapMask, b.hash>>shift&pmapMask
+	if ai == bi {
+		return &pnode{1 << ai, []pentry{{sub: pairNode(shift+pmapBits, a, b, ed)}}, ed}
+	}
+	if ai > bi {
+		a, b = b, a
+		ai, bi = bi, ai
+	}
+	return &pnode{1<<ai | 1<<bi, []pentry{a, b}, ed}
+}
+
+// del returns nil if the node is empty after removing key.
+func (n *pnode) del(shift uint, h uint64, key string, ed *edit) (*pnode, bool) {
+	bit := uint32(1) << (h >> shift & pmapMask)
+	if n == nil || n.bitmap&bit == 0 {
+		return n, false
+	}
+
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	e := n.kids[i]
+
+	if e.sub != nil {
+		sub, removed := e.sub.del(shift+pmapBits, h, key, ed)
+		if !removed {
+			return n, false
+		}
+		switch {
+		case sub == nil:
+			return n.remove(i, bit, ed), true
+		case len(sub.kids) == 1 && sub.kids[0].sub == nil:
+			// a single leaf moves up
+			e = sub.kids[0]
+		default:
+			e = pentry{sub: sub}
+		}
+	} else {
+		if e.hash != h {
+			return n, false
+		}
+
+		j := -1
+		for k := range e.leaf {
+			if e.leaf[k].key == key {
+				j = k
+				break
+			}
+		}
+		if j == -1 {
+			return n, false
+		}
+		if len(e.leaf) == 1 {
+			return n.remove(i, bit, ed), true
+		}
+
+		leaf := make([]pleaf, 0, len(e.leaf)-1)
+		e.leaf = append(append(leaf, e.leaf[:j]...), e.leaf[j+1:]...)
+	}
+
+	n = n.editable(ed)
+	n.kids[i] = e
+	return n, true
+}
+
+func (n *pnode) remove(i int, bit uint32, ed *edit) *pnode {
+	if len(n.kids) == 1 {
+		return nil
+	}
+	n = n.editable(ed)
+	n.kids = append(n.kids[:i], n.kids[i+1:]...)
+	n.bitmap &^= bit
+	return n
+}
@@ -0,0 +1,219 @@
+package jdb
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// decodeError is returned by replay when a transaction can't be decoded.
+type decodeError struct {
+	err error
+	n   int // the number of transactions decoded before err
+}
+
+func (de *decodeError) Error() string { return de.err.Error() }
+
+// RecoveryReport describes what New dropped while loading a database, see Opts.Recovery.
+type RecoveryReport struct {
+	Err          error  // the error that stopped decoding
+	LastIndex    uint64 // the index of the last good transaction
+	Transactions int    // the number of good transactions
+	Size         int64  // the size of the file before recovery
+	Repaired     bool   // true if the file got rewritten without the dropped data
+	Backup       string // the copy of the file before it got repaired, see RecoveryTruncateTorn
+}
+
+// Recovery returns what New dropped while loading the database, or nil if nothing was dropped.
+func (db *DB) Recovery() *RecoveryReport { return db.recovery }
+
+func (db *DB) recover(de *decodeError, size int64) error {
+	switch db.opts.Recovery {
+	case RecoveryFail:
+		return de.err
+	case RecoveryTruncateTorn:
+		if !db.opts.Checksum && !db.opts.ReadOnly {
+			// length prefixed formats read to the end of the file when a size in the middle is corrupt
+			return fmt.Errorf("%v (%w, a torn write can't be told from corruption)", de.err, ErrNoChecksums)
+		}
+		torn, err := db.torn(de)
+		if err != nil {
+			return err
+		}
+		if !torn {
+			return de.err
+		}
+	}
+
+	db.recovery = &RecoveryReport{
+		Err:          de.err,
+		LastIndex:    db.maxIndex,
+		Transactions: de.n,
+		Size:         size,
+	}
+
+	if db.opts.Recovery == RecoveryIgnore || db.opts.ReadOnly {
+		db.readOnly = true
+		return nil
+	}
+
+	if err := db.repair(de.n); err != nil {
+		return err
+	}
+	db.recovery.Repaired, db.recovery.Backup = true, db.name+corruptSuffix
+	return nil
+}
+
+// corruptSuffix is appended to the name of the file to keep a copy of it before repairing it.
+const corruptSuffix = ".corrupt"
+
+// torn reports whether de was caused by a torn final transaction rather than corruption in the middle of the file,
+// which is the case if no intact frame follows the bad one. The file must have checksums.
+func (db *DB) torn(de *decodeError) (bool, error) {
+	f, err := os.Open(db.name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	fh, err := readFileHeader(f)
+	if err != nil {
+		return false, err
+	}
+
+	var off int64
+	if fh != nil {
+		off = fh.size()
+	}
+
+	// skip the intact frames, if they all are the payload itself is bad
+	for {
+		if off >= st.Size() {
+			return false, nil
+		}
+		h, err := checkFrame(f, off, st.Size())
+		if err != nil {
+			if !isFrameError(err) {
+				return false, err
+			}
+			break
+		}
+		off += frameHeaderSize + h.size()
+	}
+
+	for off++; ; off++ {
+		if off, err = nextFrame(f, off); err != nil || off >= st.Size() {
+			return err == nil, err
+		}
+		if _, err = checkFrame(f, off, st.Size()); err == nil {
+			return false, nil
+		} else if !isFrameError(err) {
+			return false, err
+		}
+	}
+}
+
+// repair rewrites the first n transactions of the file to a new file and swaps it with the old one.
+// Rewriting rather than truncating works with any backend, including compressed and encrypted streams.
+func (db *DB) repair(n int) (err error) {
+	src, err := os.Open(db.name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err = readFileHeader(src); err != nil {
+		return err
+	}
+
+	rbe := db.opts.Backend()
+	if _, err = initBackend(rbe, ioutil.Discard, src, db.opts.Checksum); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(db.name), "jdb-repair")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	be := db.opts.Backend()
+	hdr, fw, err := initFile(f, be, db.opts.Checksum, db.created())
+	if err != nil {
+		return err
+	}
+
+	if err = copyTxs(be, fw, rbe, n); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = backupFile(db.name+corruptSuffix, src); err != nil {
+		return err
+	}
+
+	if err = db.swap(f, be, fw); err == nil {
+		db.hdr = hdr
+	}
+	return err
+}
+
+// copyTxs copies the first n transactions from src to dst, or all of them if n is negative.
+func copyTxs(dst Backend, fw *frameWriter, src Backend, n int) error {
+	for i := 0; n < 0 || i < n; i++ {
+		var tx fileTx
+		if err := src.Decode(&tx); err != nil {
+			if err == io.EOF && n < 0 {
+				return nil
+			}
+			return err
+		}
+		if err := encodeTx(dst, fw, &tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupFile copies src to a new file at fp, it fails if fp already exists.
+func backupFile(fp string, src *os.File) (err error) {
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(fp)
+		}
+	}()
+
+	if _, err = io.Copy(f, io.NewSectionReader(src, 0, st.Size())); err != nil {
+		return err
+	}
+	return f.Sync()
+}
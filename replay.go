@@ -0,0 +1,118 @@
+package jdb
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayOpts selects the point in history a database is rebuilt at,
+// if both Index and Time are set, the replay stops at whichever comes first.
+type ReplayOpts struct {
+	Index uint64    // the last transaction index to apply, 0 means no limit.
+	Time  time.Time // only apply transactions committed at or before Time, the zero value means no limit.
+}
+
+// after returns true if tx was committed after the point selected by ro.
+// A compacted snapshot holds every transaction before its index and is stamped with the time of the compaction.
+func (ro *ReplayOpts) after(tx *fileTx) bool {
+	if ro == nil {
+		return false
+	}
+
+	idx := tx.Index
+	if tx.Compact && idx > 0 {
+		idx--
+	}
+
+	if ro.Index > 0 && idx > ro.Index {
+		return true
+	}
+
+	return !ro.Time.IsZero() && tx.TS > ro.Time.Unix()
+}
+
+// OpenAt returns a read-only in-memory database rebuilt from the file at fp as it was at the point selected by ro,
+// a nil ro replays every transaction.
+// The file is only read and closed before OpenAt returns.
+func OpenAt(fp string, opts *Opts, ro *ReplayOpts) (*DB, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if st.Size() == 0 {
+		return newMemDB(fp, opts), nil
+	}
+
+	return openAt(f, fp, opts, ro)
+}
+
+func newMemDB(name string, opts *Opts) *DB {
+	db := &DB{
+		wmux:     newWLock(),
+		opts:     opts.withDefaults(),
+		readOnly: true,
+		name:     name,
+	}
+	db.be = db.opts.Backend()
+	db.root.Store(&node{})
+	db.txPool.New = func() interface{} { return db.createTx() }
+	return db
+}
+
+func openAt(r io.Reader, name string, opts *Opts, ro *ReplayOpts) (*DB, error) {
+	db := newMemDB(name, opts)
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if h != nil {
+		if err = h.check(db.be); err != nil {
+			return nil, err
+		}
+		db.opts.Checksum, db.hdr = h.Checksum, h
+	}
+
+	if _, err := initBackend(db.be, ioutil.Discard, br, db.opts.Checksum); err != nil {
+		return nil, err
+	}
+
+	if err := db.replay(ro); err != nil {
+		if de, ok := err.(*decodeError); ok {
+			err = de.err
+		}
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Replay returns a read-only in-memory copy of the database as it was at the point selected by ro.
+func (db *DB) Replay(ro *ReplayOpts) (*DB, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	f, err := os.Open(db.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// writers only hold wmux while appending, so stop at the end of the last committed transaction
+	size := atomic.LoadInt64(&db.size)
+	if size == 0 {
+		return newMemDB(db.Name(), &db.opts), nil
+	}
+	return openAt(io.LimitReader(f, size), db.Name(), &db.opts, ro)
+}
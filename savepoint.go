@@ -0,0 +1,127 @@
+package jdb
+
+// Savepoint marks a point in a writable transaction that can be rolled back to, see Tx.Savepoint.
+type Savepoint struct {
+	tx       *Tx
+	saved    map[*bucket]bucket // a copy of every staged bucket when the savepoint was created
+	released bool
+}
+
+// Savepoint returns a savepoint for the changes staged so far, RollbackTo discards everything staged after it.
+// Savepoints nest, rolling back to or releasing a savepoint releases the savepoints created after it.
+// Bucket handles returned by Bucket after the savepoint was created must not be used after rolling back to it.
+func (tx *Tx) Savepoint() (*Savepoint, error) {
+	if err := tx.writable(); err != nil {
+		return nil, err
+	}
+
+	sp := &Savepoint{tx: tx, saved: map[*bucket]bucket{}}
+	sp.save(tx.tmpBucket)
+	tx.savepoints = append(tx.savepoints, sp)
+	return sp, nil
+}
+
+// Nested calls fn with a savepoint, if fn returns an error only the changes it staged are rolled back.
+func (tx *Tx) Nested(fn func(tx *Tx) error) error {
+	sp, err := tx.Savepoint()
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		sp.RollbackTo()
+		sp.Release()
+		return err
+	}
+
+	return sp.Release()
+}
+
+func (sp *Savepoint) save(b *bucket) {
+	sp.saved[b] = bucket{Buckets: copyBuckets(b.Buckets), Data: copyData(b.Data), Seq: b.Seq}
+	for _, c := range b.Buckets {
+		if c != nil {
+			sp.save(c)
+		}
+	}
+}
+
+// RollbackTo discards the changes staged since the savepoint was created, the savepoint can be rolled back to again.
+func (sp *Savepoint) RollbackTo() error {
+	if err := sp.valid(); err != nil {
+		return err
+	}
+
+	// the buckets are restored in place, so bucket handles opened before the savepoint keep working
+	for b, cp := range sp.saved {
+		b.Buckets, b.Data, b.Seq = copyBuckets(cp.Buckets), copyData(cp.Data), cp.Seq
+	}
+
+	sp.releaseAfter(false)
+	return nil
+}
+
+// Release forgets the savepoint and keeps the changes staged since it was created.
+func (sp *Savepoint) Release() error {
+	if err := sp.valid(); err != nil {
+		return err
+	}
+	sp.releaseAfter(true)
+	return nil
+}
+
+func (sp *Savepoint) valid() error {
+	if sp.released {
+		return ErrSavepointReleased
+	}
+	if sp.tx.closed {
+		return ErrTxClosed
+	}
+	return nil
+}
+
+// releaseAfter releases the savepoints created after sp, and sp itself if self is true.
+func (sp *Savepoint) releaseAfter(self bool) {
+	tx := sp.tx
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i] == sp {
+			if self {
+				sp.released = true
+				i--
+			}
+			tx.savepoints = tx.savepoints[:i+1]
+			return
+		}
+		tx.savepoints[i].released = true
+	}
+}
+
+// releaseSavepoints is called when the transaction is closed.
+func (tx *Tx) releaseSavepoints() {
+	for _, sp := range tx.savepoints {
+		sp.released = true
+	}
+	tx.savepoints = nil
+}
+
+func copyData(m map[string]Value) map[string]Value {
+	if m == nil {
+		return nil
+	}
+	cp := make(map[string]Value, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+func copyBuckets(m map[string]*bucket) map[string]*bucket {
+	if m == nil {
+		return nil
+	}
+	cp := make(map[string]*bucket, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
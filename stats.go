@@ -0,0 +1,52 @@
+package jdb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is returned by DB.Stats.
+type Stats struct {
+	Commits   int64
+	Rollbacks int64
+
+	FileSize int64 // the size of the database file
+	LiveSize int64 // the size of all the keys, values and bucket names in the database
+
+	TxsSinceCompact int64 // the number of transactions written since the file was last compacted
+	Compactions     int64 // includes AutoCompactions
+	AutoCompactions int64
+	LastCompact     CompactStats
+}
+
+// CompactStats describes a compaction.
+type CompactStats struct {
+	Time     time.Time
+	Duration time.Duration
+	Auto     bool  // it was started by Opts.AutoCompact
+	Before   int64 // the size of the file before the compaction
+	After    int64 // the size of the file after the compaction
+	Err      error
+}
+
+// Stats returns the current statistics of the database, it doesn't wait for writers.
+func (db *DB) Stats() Stats {
+	db.statsMux.Lock()
+	st := db.stats
+	db.statsMux.Unlock()
+
+	st.Commits = atomic.LoadInt64(&db.commits)
+	st.Rollbacks = atomic.LoadInt64(&db.rollbacks)
+	st.FileSize = atomic.LoadInt64(&db.size)
+	st.LiveSize = db.snapshot().size
+	st.TxsSinceCompact = atomic.LoadInt64(&db.txs)
+	return st
+}
+
+func (db *DB) addCommits(n int) {
+	atomic.AddInt64(&db.commits, int64(n))
+	atomic.AddInt64(&db.txs, int64(n))
+	db.kickCompactor()
+}
+
+func (db *DB) addRollbacks(n int) { atomic.AddInt64(&db.rollbacks, int64(n)) }
@@ -0,0 +1,95 @@
+package jdb
+
+import (
+	"os"
+	"time"
+)
+
+// fsync syncs the database file, the tests replace it to simulate crashes.
+var fsync = (*os.File).Sync
+
+// syncTx is called with wmux held after transactions were written, it only syncs the file with SyncAlways.
+func (db *DB) syncTx() error {
+	if db.opts.SyncMode == SyncAlways {
+		return fsync(db.f)
+	}
+	db.dirty = true
+	return nil
+}
+
+// flush syncs the file if there are commits that weren't synced yet, it must be called with wmux held.
+func (db *DB) flush() error {
+	if !db.dirty || db.isClosed() {
+		return nil
+	}
+	if err := fsync(db.f); err != nil {
+		return err
+	}
+	db.dirty = false
+	return nil
+}
+
+// Sync writes every committed transaction to disk, it's only needed with SyncEvery and SyncNever.
+// If a background sync failed since the last call, its error is returned, some transactions may have been lost.
+func (db *DB) Sync() error {
+	db.wmux.Lock()
+	defer db.wmux.Unlock()
+
+	if db.readOnly {
+		return nil
+	}
+	if db.isClosed() {
+		return ErrClosed
+	}
+
+	if err := db.flush(); err != nil {
+		return err
+	}
+	err := db.syncErr
+	db.syncErr = nil
+	return err
+}
+
+// startSyncer starts the background goroutine used by SyncEvery.
+func (db *DB) startSyncer() {
+	d := time.Duration(db.opts.SyncMode)
+	if d <= 0 || db.readOnly {
+		return
+	}
+
+	stop := make(chan struct{})
+	db.syncStop = stop
+	db.syncWg.Add(1)
+	go func() {
+		defer db.syncWg.Done()
+
+		t := time.NewTicker(d)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+
+			db.wmux.Lock()
+			if err := db.flush(); err != nil {
+				db.syncErr = err
+			}
+			db.wmux.Unlock()
+		}
+	}()
+}
+
+func (db *DB) stopSyncer() {
+	db.wmux.Lock()
+	stop := db.syncStop
+	db.syncStop = nil
+	db.wmux.Unlock()
+
+	if stop != nil {
+		close(stop)
+		db.syncWg.Wait()
+	}
+}
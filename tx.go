@@ -1,5 +1,7 @@
 package jdb
 
+import "context"
+
 const RootBucket = "☢"
 
 type Value []byte
@@ -21,11 +23,66 @@ type fileTx struct {
 
 type Tx struct {
 	BucketTx
+	managed bool // closed by Read, Update or Batch
+	closed  bool
+	ctx     context.Context
+
+	savepoints []*Savepoint
+}
+
+// Context returns the context passed to ReadContext or UpdateContext, or context.Background().
+func (tx *Tx) Context() context.Context {
+	if tx.ctx == nil {
+		return context.Background()
+	}
+	return tx.ctx
+}
+
+// Commit writes the changes of a transaction started with Begin and closes it,
+// the transaction is rolled back if writing fails.
+func (tx *Tx) Commit() error {
+	switch {
+	case tx.managed:
+		return ErrTxManaged
+	case tx.closed:
+		return ErrTxClosed
+	case !tx.rw:
+		return ErrReadOnly
+	}
+
+	defer tx.close()
+	return tx.db.writeTx(tx)
+}
+
+// Rollback discards the changes of a transaction started with Begin and closes it.
+func (tx *Tx) Rollback() error {
+	switch {
+	case tx.managed:
+		return ErrTxManaged
+	case tx.closed:
+		return ErrTxClosed
+	}
+
+	if tx.rw {
+		tx.db.addRollbacks(1)
+	}
+	tx.close()
+	return nil
+}
+
+func (tx *Tx) close() {
+	tx.releaseSavepoints()
+	tx.closed = true
+	tx.tmpBucket, tx.realBucket = nil, nil
+	if tx.rw {
+		tx.db.wmux.Unlock()
+	}
 }
 
 type bucket struct {
 	Buckets map[string]*bucket `json:"b,omitempty"`
 	Data    map[string]Value   `json:"d,omitempty"`
+	Seq     uint64             `json:"s,omitempty"`
 }
 
 func (b *bucket) Get(key string) Value {
@@ -73,32 +130,51 @@ func (b *bucket) DeleteBucket(name string) {
 
 type BucketTx struct {
 	db         *DB
+	tx         *Tx
 	tmpBucket  *bucket
-	realBucket *bucket
+	realBucket *node // the snapshot the transaction started with
 	rw         bool
 }
 
+func (b *BucketTx) isClosed() bool { return b.tx != nil && b.tx.closed }
+
+// writable returns the error for modifying the bucket, if any.
+func (b *BucketTx) writable() error {
+	if b.isClosed() {
+		return ErrTxClosed
+	}
+	if !b.rw {
+		return ErrReadOnly
+	}
+	return nil
+}
+
 func (b *BucketTx) Get(key string) Value {
+	if b.isClosed() {
+		return nil
+	}
 	if v := b.tmpBucket.Get(key); v != nil {
 		return v
 	}
-	return b.realBucket.Get(key)
+	return b.realBucket.get(key)
 }
 
 func (b *BucketTx) GetObject(key string, out interface{}) error {
 	v := b.Get(key)
-	return b.db.be.Unmarshal(v, out)
+	return b.db.backend().Unmarshal(v, out)
 }
 
 // GetAll returns a map of all the key/values in *this* bucket.
 func (b *BucketTx) GetAll() map[string]Value {
+	if b.isClosed() {
+		return nil
+	}
 	out := make(map[string]Value)
 
-	if rb := b.realBucket; rb != nil {
-		for k, v := range rb.Data {
-			out[k] = v
-		}
-	}
+	b.realBucket.forEach(func(k string, v Value) bool {
+		out[k] = v
+		return true
+	})
 
 	for k, v := range b.tmpBucket.Data {
 		out[k] = v
@@ -108,8 +184,8 @@ func (b *BucketTx) GetAll() map[string]Value {
 }
 
 func (b *BucketTx) Set(key string, val Value) error {
-	if !b.rw {
-		return ErrReadOnly
+	if err := b.writable(); err != nil {
+		return err
 	}
 	if val == nil {
 		return ErrNilValue
@@ -119,7 +195,7 @@ func (b *BucketTx) Set(key string, val Value) error {
 }
 
 func (b *BucketTx) SetObject(key string, val interface{}) error {
-	v, err := b.db.be.Marshal(val)
+	v, err := b.db.backend().Marshal(val)
 	if err != nil {
 		return err
 	}
@@ -127,14 +203,17 @@ func (b *BucketTx) SetObject(key string, val interface{}) error {
 }
 
 func (b *BucketTx) Delete(key string) error {
-	if !b.rw {
-		return ErrReadOnly
+	if err := b.writable(); err != nil {
+		return err
 	}
 	b.tmpBucket.Set(key, nil)
 	return nil
 }
 
 func (b *BucketTx) ForEach(fn func(key string, val Value) error) error {
+	if b.isClosed() {
+		return ErrTxClosed
+	}
 	for k, v := range b.tmpBucket.Data {
 		if v == nil {
 			continue
@@ -144,36 +223,57 @@ func (b *BucketTx) ForEach(fn func(key string, val Value) error) error {
 			return err
 		}
 	}
-	if b.realBucket == nil {
-		return nil
-	}
-	for k, v := range b.realBucket.Data {
+	var err error
+	b.realBucket.forEach(func(k string, v Value) bool {
 		if _, ok := b.tmpBucket.Data[k]; ok {
-			continue
-		}
-		if err := fn(k, v); err != nil {
-			return err
+			return true
 		}
+		err = fn(k, v)
+		return err == nil
+	})
+	return err
+}
+
+// Sequence returns the current unique id of the bucket.
+func (b *BucketTx) Sequence() uint64 {
+	if b.isClosed() {
+		return 0
 	}
-	return nil
+	if seq := b.tmpBucket.Seq; seq > 0 {
+		return seq
+	}
+	return b.realBucket.sequence()
+}
+
+// NextSequence returns a new unique id for the bucket, the counter is stored with the bucket
+// so it survives restarts and compaction.
+func (b *BucketTx) NextSequence() (uint64, error) {
+	if err := b.writable(); err != nil {
+		return 0, err
+	}
+	b.tmpBucket.Seq = b.Sequence() + 1
+	return b.tmpBucket.Seq, nil
 }
 
 // Bucket returns a bucket with the specified name, creating it if it doesn't already exist.
 func (b *BucketTx) Bucket(name string) *BucketTx {
-	var rb *bucket
-	if b.realBucket != nil {
-		rb = b.realBucket.Buckets[name]
+	if b.isClosed() {
+		return &BucketTx{db: b.db, tx: b.tx}
 	}
 	return &BucketTx{
 		db:         b.db,
+		tx:         b.tx,
 		tmpBucket:  b.tmpBucket.Bucket(name),
-		realBucket: rb,
+		realBucket: b.realBucket.bucket(name),
 		rw:         b.rw,
 	}
 }
 
 // Buckets returns a slice of child buckets.
 func (b *BucketTx) Buckets() []string {
+	if b.isClosed() {
+		return nil
+	}
 	var out []string
 
 	tb := b.tmpBucket.Buckets
@@ -185,22 +285,20 @@ func (b *BucketTx) Buckets() []string {
 		out = append(out, bn)
 	}
 
-	if rb := b.realBucket; rb != nil {
-		for bn := range rb.Buckets {
-			if _, ok := tb[bn]; ok { // ignore buckets that got modified in the tx
-				continue
-			}
+	b.realBucket.forEachBucket(func(bn string, _ *node) bool {
+		if _, ok := tb[bn]; !ok { // ignore buckets that got modified in the tx
 			out = append(out, bn)
 		}
-	}
+		return true
+	})
 
 	return out
 }
 
 // DeleteBucket opens a portal into a 2D universe full of wonders.
 func (b *BucketTx) DeleteBucket(name string) error {
-	if !b.rw {
-		return ErrReadOnly
+	if err := b.writable(); err != nil {
+		return err
 	}
 
 	if b.tmpBucket.Buckets == nil {
@@ -0,0 +1,25 @@
+package jdb
+
+import "context"
+
+// wlock is a mutex that can stop waiting when a context is done.
+type wlock chan struct{}
+
+func newWLock() wlock { return make(wlock, 1) }
+
+func (l wlock) Lock() { l <- struct{}{} }
+
+func (l wlock) Unlock() { <-l }
+
+// LockContext returns ctx.Err() if ctx is done before the lock is acquired.
+func (l wlock) LockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}